@@ -0,0 +1,118 @@
+package main
+
+import (
+	"./protocol"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// A rejected client has this long to send its request before it gets the 403 response
+const rejectReadTimeout = 5 * time.Second
+
+// ClientLists restrict the networks that clients connect from. A denied network wins over an allowed one,
+// and an empty allow list allows every network that isn't denied.
+type ClientLists struct {
+	Allow, Deny []*net.IPNet
+}
+
+func parseNetworks(items []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, item := range items {
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %s", item)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func compileClientLists(allow, deny []string) (ClientLists, error) {
+	var lists ClientLists
+	var err error
+	lists.Allow, err = parseNetworks(allow)
+	if err != nil {
+		return lists, err
+	}
+	lists.Deny, err = parseNetworks(deny)
+	return lists, err
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Allows checks the address of a client. Clients connected to a Unix socket are always allowed,
+// as the permissions of the socket file restrict them.
+func (lists ClientLists) Allows(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return true
+	}
+	if containsIP(lists.Deny, tcpAddr.IP) {
+		return false
+	}
+	return len(lists.Allow) == 0 || containsIP(lists.Allow, tcpAddr.IP)
+}
+
+// clientAllowed tells whether a client may use the proxy for plain HTTP or for tunnels
+func (settings *Settings) clientAllowed(addr net.Addr) bool {
+	return settings.httpClients.Allows(addr) || settings.tunnelClients.Allows(addr)
+}
+
+// clientListsFor returns the lists that apply to requests with a method
+func (settings *Settings) clientListsFor(method string) ClientLists {
+	if method == protocol.MethodConnect {
+		return settings.tunnelClients
+	}
+	return settings.httpClients
+}
+
+// rejectClient answers the first request of a client that isn't allowed to use the proxy
+func rejectClient(settings *Settings, clientConn *protocol.Conn) {
+	log.Printf("client %s isn't allowed to use the proxy\n", clientConn.RemoteAddr())
+
+	// Closing a connection with unread data resets it, so the client could miss the response
+	clientConn.SetReadDeadline(time.Now().Add(rejectReadTimeout))
+	request := new(protocol.Request)
+	if request.ReadFrom(clientConn) == nil {
+		request.DiscardBody()
+	}
+	err := sendErrorResponse(settings, clientConn, &protocol.Error{protocol.StatusForbidden,
+		errors.New("your network isn't allowed to use this proxy")})
+	if err != nil {
+		log.Println("error on sending a error response: " + err.Error())
+	}
+}
+
+func listenUnix(path string) {
+	// A socket left by a previous run would make Listen fail
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	log.Printf("listening on the Unix socket %s\n", path)
+	ln := connections.listen("unix", path)
+	connections.serve(ln, func(conn net.Conn) { runHandleClient(conn, "", "") })
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"./protocol"
+	"net"
+	"testing"
+)
+
+func TestClientLists(t *testing.T) {
+	lists, err := compileClientLists([]string{"192.168.0.0/16", "10.0.0.1", "2001:db8::/32"}, []string{"192.168.1.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		addr   net.Addr
+		allows bool
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("192.168.2.3")}, true},
+		{&net.TCPAddr{IP: net.ParseIP("192.168.1.3")}, false},
+		{&net.TCPAddr{IP: net.ParseIP("10.0.0.1")}, true},
+		{&net.TCPAddr{IP: net.ParseIP("10.0.0.2")}, false},
+		{&net.TCPAddr{IP: net.ParseIP("::ffff:192.168.2.3")}, true},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::1")}, true},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db9::1")}, false},
+		{&net.UnixAddr{Name: "/run/proxy.sock", Net: "unix"}, true},
+	}
+	for _, test := range tests {
+		if allows := lists.Allows(test.addr); allows != test.allows {
+			t.Errorf("Allows(%s) = %v, want %v", test.addr, allows, test.allows)
+		}
+	}
+
+	var empty ClientLists
+	if !empty.Allows(&net.TCPAddr{IP: net.ParseIP("203.0.113.1")}) {
+		t.Error("empty lists deny a client")
+	}
+	if _, err := compileClientLists([]string{"localhost"}, nil); err == nil {
+		t.Error("a host name is accepted as a network")
+	}
+}
+
+func TestClientListsForMethod(t *testing.T) {
+	settings := loadTestSettings(t, map[string]interface{}{
+		"DenyClients":        []string{"127.0.0.1"},
+		"AllowTunnelClients": []string{"127.0.0.0/8"},
+	})
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	if settings.clientListsFor(protocol.MethodGet).Allows(addr) {
+		t.Error("a denied client may send GET requests")
+	}
+	if !settings.clientListsFor(protocol.MethodConnect).Allows(addr) {
+		t.Error("a client allowed to open tunnels can't send CONNECT")
+	}
+	if !settings.clientAllowed(addr) {
+		t.Error("a client allowed to open tunnels can't connect")
+	}
+
+	// bufferConn connects from 127.0.0.1
+	response := proxyRequest(t, settings, "GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	if response != "your network isn't allowed to send GET requests" {
+		t.Errorf("got %q for a denied client", response)
+	}
+}
+
+func TestRejectClient(t *testing.T) {
+	settings := loadTestSettings(t, nil)
+	conn := newBufferConn("GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	rejectClient(settings, protocol.NewConn(conn))
+	response, _ := readResponse(t, conn, protocol.MethodGet)
+	if response.Code != protocol.StatusForbidden {
+		t.Errorf("got %d, want %d", response.Code, protocol.StatusForbidden)
+	}
+}
@@ -2,23 +2,49 @@ package main
 
 import (
 	"./protocol"
+	"bufio"
 	"bytes"
 	"fmt"
 	"github.com/PuerkitoBio/goquery"
+	"github.com/andybalholm/cascadia"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/charset"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/transform"
+	"io"
 	"io/ioutil"
+	"mime"
+	"net/url"
 	"strings"
 )
 
-func modifyContent(content []byte, selectors []string) []byte {
+func removalSummary(count int) string {
+	return fmt.Sprintf("<!-- This page was reassembled by %s. %d advertisment elements were removed. -->",
+		ServerName, count)
+}
+
+// matchAny combines the selectors of several rules, so they can be applied at once
+func matchAny(matchers []cascadia.Selector) cascadia.Selector {
+	return func(node *html.Node) bool {
+		for _, matcher := range matchers {
+			if matcher.Match(node) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+func modifyContent(content []byte, matcher cascadia.Selector, injections []Injection) []byte {
 	doc, err := goquery.NewDocumentFromReader(bytes.NewReader(content))
 	if err != nil {
 		return content
 	}
 
-	ads := doc.Find(strings.Join(selectors, ", "))
-	ads.ReplaceWithHtml("<!-- An advertisment here was removed -->")
-	doc.AppendHtml(fmt.Sprintf("<!-- This page was reassembled by %s. %d advertisment elements were removed. -->",
-		ServerName, ads.Length()))
+	ads := doc.FindMatcher(matcher)
+	ads.ReplaceWithHtml(removedElementComment)
+	injectIntoDocument(doc, injections)
+	doc.AppendHtml(removalSummary(ads.Length()))
 
 	html, err := doc.Html()
 	if err != nil {
@@ -27,48 +53,180 @@ func modifyContent(content []byte, selectors []string) []byte {
 	return []byte(html)
 }
 
-func ModifyResponse(url string, response *protocol.Response) error {
-	var selectors []string
-	for _, rule := range urlRules {
+// modifyDocument rewrites the whole body at once, which is required by selectors that need lookahead
+func modifyDocument(reader io.Reader, writer io.Writer, matcher cascadia.Selector, injections []Injection) error {
+	content, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+
+	_, err = writer.Write(modifyContent(content, matcher, injections))
+	return err
+}
+
+// Peeking this much is enough for charset.DetermineEncoding to find a <meta> tag
+const charsetPrescanSize = 1024
+
+type encodingWriter struct {
+	*transform.Writer
+	next io.WriteCloser
+}
+
+func (writer encodingWriter) Close() error {
+	err := writer.Writer.Close()
+	if err != nil {
+		return err
+	}
+	return writer.next.Close()
+}
+
+// metaCharset finds the charset declared by a <meta> tag in the beginning of a page
+func metaCharset(prefix []byte) (encoding.Encoding, string) {
+	tokenizer := html.NewTokenizer(bytes.NewReader(prefix))
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			return nil, ""
+		case html.StartTagToken, html.SelfClosingTagToken:
+			token := tokenizer.Token()
+			if token.Data != "meta" {
+				continue
+			}
+			label := ""
+			for _, attr := range token.Attr {
+				switch strings.ToLower(attr.Key) {
+				case "charset":
+					label = attr.Val
+				case "content":
+					if _, params, err := mime.ParseMediaType(attr.Val); err == nil && label == "" {
+						label = params["charset"]
+					}
+				}
+			}
+			if label == "" {
+				continue
+			}
+			pageEncoding, name := charset.Lookup(label)
+			if strings.HasPrefix(name, "utf-16") {
+				// A page that can be read as ASCII isn't UTF-16 (HTML, section 12.2.3.2)
+				return encoding.Nop, "utf-8"
+			}
+			return pageEncoding, name
+		}
+	}
+}
+
+// decodeCharset detects the charset of a page by a BOM, Content-Type or a <meta> tag and makes
+// the reader return UTF-8 text. The writer encodes the rewritten text back to the same charset,
+// so the declarations in Content-Type and the page itself stay correct. A page without
+// a declared charset is passed unchanged, as guessing it could corrupt the text.
+func decodeCharset(reader io.Reader, writer io.WriteCloser, contentType string) (io.Reader, io.WriteCloser) {
+	buffered := bufio.NewReaderSize(reader, charsetPrescanSize)
+	prefix, _ := buffered.Peek(charsetPrescanSize)
+	pageEncoding, name, certain := charset.DetermineEncoding(prefix, contentType)
+	if !certain {
+		pageEncoding, name = metaCharset(prefix)
+	}
+	if pageEncoding == nil || name == "utf-8" {
+		return buffered, writer
+	}
+
+	encoder := encoding.ReplaceUnsupported(pageEncoding.NewEncoder())
+	return transform.NewReader(buffered, pageEncoding.NewDecoder()),
+		encodingWriter{transform.NewWriter(writer, encoder), writer}
+}
+
+// isHTML checks the media type of a Content-Type value, which is case-insensitive
+// and may be followed by parameters with any spacing (RFC 7231, section 3.1.1.1)
+func isHTML(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	// A broken parameter doesn't change the type
+	return (err == nil || err == mime.ErrInvalidMediaParameter) && mediaType == "text/html"
+}
+
+// mayBeHTML tells whether a request may be answered with a page rather than with an image, a script
+// or another resource that the rewriting rules don't apply to
+func mayBeHTML(rawURL string, request *protocol.Request) bool {
+	requestURL, err := url.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	return guessResourceType(request, requestURL)&(typeDocument|typeSubdocument|typeOther) != 0
+}
+
+// matchingRules returns the rules from the config and the filter lists that apply to a page.
+// It's called once per request, and the result is passed to ModifyRequest, cacheKey and ModifyResponse.
+func (settings *Settings) matchingRules(url string, request *protocol.Request) []URLRule {
+	var rules []URLRule
+	for _, rule := range settings.urlRules {
 		if rule.Pattern.MatchString(url) {
-			selectors = append(selectors, rule.Selectors...)
+			rules = append(rules, rule)
 		}
 	}
-	if selectors == nil {
-		return nil
+	// Generic hiding rules apply to any page, so they would affect every resource otherwise
+	if settings.filterList != nil && mayBeHTML(url, request) {
+		if rule, ok := settings.filterList.HidingRule(url); ok {
+			rules = append(rules, rule)
+		}
 	}
+	return rules
+}
 
-	value, ok := response.Header("Content-Type")
-	if !ok {
-		return nil
+// ModifyRequest makes the origin respond in a form that ModifyResponse is able to rewrite
+func ModifyRequest(rules []URLRule, request *protocol.Request) {
+	if rules != nil {
+		request.RestrictAcceptEncoding()
 	}
-	parts := strings.Split(value, "; ")
-	if len(parts) == 0 || parts[0] != "text/html" {
+}
+
+func ModifyResponse(rules []URLRule, response *protocol.Response) error {
+	if rules == nil || response.Body == nil || !response.CanDecodeBody() {
 		return nil
 	}
+	var matchers []cascadia.Selector
+	var injections []Injection
+	lookahead := false
+	for _, rule := range rules {
+		matchers = append(matchers, rule.Matchers...)
+		injections = append(injections, rule.Injections...)
+		lookahead = lookahead || rule.Lookahead
+	}
 
-	reader, err := response.DecodedBodyReader()
-	if err != nil {
-		return err
+	value, ok := response.Header("Content-Type")
+	if !ok || !isHTML(value) {
+		return nil
 	}
-	defer reader.Close()
 
-	content, err := ioutil.ReadAll(reader)
+	decodedReader, err := response.DecodedBodyReader()
 	if err != nil {
 		return err
 	}
 
-	content = modifyContent(content, selectors)
-
-	response.SetChunked(false)
-	response.Body = protocol.NewPipe()
+	original, rewritten := response.Body, protocol.NewPipe()
+	response.SetChunked(true)
+	// The pipe is kept here, as Body may be replaced again by a later stage
+	response.Body = rewritten
+	encodedWriter := response.DecodedBodyWriter()
 	go func() {
-		writer := response.DecodedBodyWriter()
-		_, err := writer.Write(content)
+		defer decodedReader.Close()
+
+		var err error
+		reader, writer := decodeCharset(decodedReader, encodedWriter, value)
+		if lookahead {
+			err = modifyDocument(reader, writer, matchAny(matchers), injections)
+		} else {
+			err = newStreamRewriter(matchers, injections).Rewrite(reader, writer)
+		}
+		if err == nil {
+			err = writer.Close()
+		}
 		if err != nil {
-			response.Body.Writer.CloseWithError(err)
+			original.Reader.CloseWithError(err)
+		} else {
+			// Consume the rest of the original body, so the server connection may be reused
+			_, err = io.Copy(ioutil.Discard, original.Reader)
 		}
-		response.Body.Writer.CloseWithError(writer.Close())
+		rewritten.Writer.CloseWithError(err)
 	}()
 	return nil
 }
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"./protocol"
+	"github.com/andybalholm/cascadia"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestIsHTML(t *testing.T) {
+	tests := []struct {
+		contentType string
+		want        bool
+	}{
+		{"text/html", true},
+		{"text/html; charset=utf-8", true},
+		{"text/html;charset=windows-1251", true},
+		{"Text/HTML", true},
+		{"text/html ; charset=\"utf-8\"", true},
+		{"text/html; charset", true},
+		{"text/plain", false},
+		{"application/xhtml+xml", false},
+		{"text/htmlx", false},
+		{"", false},
+	}
+	for _, test := range tests {
+		if got := isHTML(test.contentType); got != test.want {
+			t.Errorf("isHTML(%q) = %v, want %v", test.contentType, got, test.want)
+		}
+	}
+}
+
+// modifyPage runs ModifyResponse with a rule removing ".ad" on a response and returns its body
+func modifyPage(t *testing.T, contentType, page string) string {
+	response := new(protocol.Response)
+	input := "HTTP/1.1 200 OK\r\nContent-Type: " + contentType + "\r\nContent-Length: " +
+		strconv.Itoa(len(page)) + "\r\n\r\n" + page
+	if err := response.ReadFrom(newBufferConn(input), protocol.MethodGet); err != nil {
+		t.Fatal(err)
+	}
+	rules := []URLRule{{Matchers: []cascadia.Selector{cascadia.MustCompile(".ad")}}}
+	if err := ModifyResponse(rules, response); err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(response.Body.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestModifyResponseContentTypes(t *testing.T) {
+	page := `<html><body><div class="ad">buy</div><p>text</p></body></html>`
+	for _, contentType := range []string{"text/html", "Text/HTML", "text/html;charset=utf-8", "TEXT/html ; charset=UTF-8"} {
+		if body := modifyPage(t, contentType, page); strings.Contains(body, "buy") || !strings.Contains(body, "text") {
+			t.Errorf("%s: got %q", contentType, body)
+		}
+	}
+	for _, contentType := range []string{"text/plain", "application/json"} {
+		if body := modifyPage(t, contentType, page); body != page {
+			t.Errorf("%s: the body is changed to %q", contentType, body)
+		}
+	}
+}
+
+func TestModifyResponseKeepsCharset(t *testing.T) {
+	// "Привет" in windows-1251
+	text := "\xcf\xf0\xe8\xe2\xe5\xf2"
+	page := `<html><body><div class="ad">x</div><p>` + text + `</p></body></html>`
+	body := modifyPage(t, "text/html;charset=windows-1251", page)
+	if strings.Contains(body, `class="ad"`) || !strings.Contains(body, text) {
+		t.Errorf("got %q", body)
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"./protocol"
+	"bufio"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/bcrypt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// Checking a bcrypt hash takes a while, so the credentials found valid are remembered
+// until the file is reloaded. The limit keeps guessing clients from filling the memory.
+const maxVerifiedCredentials = 1024
+
+// Passwords of unknown users are checked against this hash of the default cost,
+// so the response time doesn't tell whether a username exists
+var dummyHash = []byte("$2a$10$/7lOrMViORM1D7.DRzmUyulwFz5.oOrKPoCdyC2DEaTVhw52nVIKq")
+
+// UserConfig is the policy of a user. Rules are applied in addition to the global ones.
+type UserConfig struct {
+	AllowTunnelsTo    string // replaces the global AllowTunnelsTo if set
+	RemoveElements    map[string][]string
+	InjectElements    map[string][]InjectionConfig
+	BlockRequests     []BlockRuleConfig
+	IgnoreGlobalRules bool // don't apply RemoveElements, InjectElements, BlockRequests and FilterLists from the global config
+}
+
+// Credentials are the users and bcrypt hashes of their passwords from an htpasswd file
+type Credentials struct {
+	hashes map[string][]byte
+
+	mutex    sync.Mutex
+	verified map[[sha256.Size]byte]bool
+}
+
+func loadCredentials(filename string) (*Credentials, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	credentials := &Credentials{
+		hashes:   make(map[string][]byte),
+		verified: make(map[[sha256.Size]byte]bool),
+	}
+	scanner := bufio.NewScanner(f)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("%s:%d: expected username:hash", filename, lineNumber)
+		}
+		if _, err := bcrypt.Cost([]byte(parts[1])); err != nil {
+			return nil, fmt.Errorf("%s:%d: only bcrypt hashes are supported", filename, lineNumber)
+		}
+		credentials.hashes[parts[0]] = []byte(parts[1])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return credentials, nil
+}
+
+func (credentials *Credentials) Has(username string) bool {
+	_, ok := credentials.hashes[username]
+	return ok
+}
+
+func (credentials *Credentials) Check(username, password string) bool {
+	hash, ok := credentials.hashes[username]
+	if !ok {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return false
+	}
+	key := sha256.Sum256([]byte(username + "\x00" + password))
+	credentials.mutex.Lock()
+	verified := credentials.verified[key]
+	credentials.mutex.Unlock()
+	if verified {
+		return true
+	}
+
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return false
+	}
+	credentials.mutex.Lock()
+	if len(credentials.verified) >= maxVerifiedCredentials {
+		credentials.verified = make(map[[sha256.Size]byte]bool)
+	}
+	credentials.verified[key] = true
+	credentials.mutex.Unlock()
+	return true
+}
+
+// authenticate checks the Proxy-Authorization header of a request and removes it,
+// so it isn't passed further. It returns an empty username if authentication is disabled.
+func (settings *Settings) authenticate(request *protocol.Request) (string, error) {
+	if settings.credentials == nil {
+		return "", nil
+	}
+	value, ok := request.Header("Proxy-Authorization")
+	if !ok {
+		return "", errors.New("proxy authentication is required")
+	}
+	request.DeleteHeader("Proxy-Authorization")
+
+	parts := strings.SplitN(strings.TrimSpace(value), " ", 2)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], "Basic") {
+		return "", errors.New("only Basic proxy authentication is supported")
+	}
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return "", errors.New("invalid Basic credentials")
+	}
+	credentials := strings.SplitN(string(decoded), ":", 2)
+	if len(credentials) != 2 || !settings.credentials.Check(credentials[0], credentials[1]) {
+		return "", fmt.Errorf("invalid credentials for user %s", credentials[0])
+	}
+	return credentials[0], nil
+}
+
+// forUser returns the settings with the policy of a user applied
+func (settings *Settings) forUser(username string) *Settings {
+	var result Settings
+	if userSettings, ok := settings.users[username]; ok {
+		result = *userSettings
+	} else {
+		result = *settings
+	}
+	result.username = username
+	return &result
+}
+
+// withUserPolicy makes the settings of a user from the global ones
+func (settings *Settings) withUserPolicy(userConfig UserConfig) (*Settings, error) {
+	result := *settings
+	result.users = nil
+
+	var err error
+	if userConfig.AllowTunnelsTo != "" {
+		result.AllowTunnelsTo = userConfig.AllowTunnelsTo
+		result.allowedTunnelAddrRegexp, err = regexp.Compile(userConfig.AllowTunnelsTo)
+		if err != nil {
+			return nil, fmt.Errorf("can't compile a regexp from AllowTunnelsTo: %s", err)
+		}
+	}
+
+	if userConfig.IgnoreGlobalRules {
+		result.urlRules, result.blockRules, result.filterList = nil, nil, nil
+	}
+	urlRules, err := compileURLRules(userConfig.RemoveElements, userConfig.InjectElements)
+	if err != nil {
+		return nil, err
+	}
+	blockRules, err := compileBlockRules(userConfig.BlockRequests)
+	if err != nil {
+		return nil, err
+	}
+	result.urlRules = append(append([]URLRule(nil), result.urlRules...), urlRules...)
+	result.blockRules = append(append([]BlockRule(nil), result.blockRules...), blockRules...)
+
+	// Pages rewritten by other rules are cached separately
+	if userConfig.IgnoreGlobalRules || len(urlRules) > 0 {
+		rules, err := json.Marshal([]interface{}{settings.rulesVersion, userConfig.IgnoreGlobalRules,
+			userConfig.RemoveElements, userConfig.InjectElements})
+		if err != nil {
+			return nil, err
+		}
+		hash := sha256.Sum256(rules)
+		result.rulesVersion = hex.EncodeToString(hash[:8])
+	}
+	return &result, nil
+}
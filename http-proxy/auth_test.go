@@ -0,0 +1,136 @@
+package main
+
+import (
+	"./protocol"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUserPolicyKeepsTemplates(t *testing.T) {
+	settings := loadTestSettings(t, map[string]interface{}{
+		"Users": map[string]interface{}{
+			"alice": map[string]interface{}{
+				"BlockRequests": []map[string]string{{"URL": "^http://ads\\.example\\.com/"}},
+			},
+		},
+	})
+	userSettings := settings.forUser("alice")
+
+	url := "http://ads.example.com/banner"
+	request := readRequest(t, "GET "+url+" HTTP/1.1\r\nHost: ads.example.com\r\n\r\n")
+	action, ruleText, blocked := userSettings.findBlockRule(url, request)
+	if !blocked {
+		t.Fatal("the rule of the user doesn't block the request")
+	}
+	if _, _, blocked := settings.forUser("bob").findBlockRule(url, request); blocked {
+		t.Error("the rule of a user applies to others")
+	}
+
+	conn := newBufferConn("")
+	err := sendBlockedResponse(userSettings, conn, url, request, action, ruleText, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, body := readResponse(t, conn, protocol.MethodGet)
+	if response.Code != protocol.StatusForbidden || !strings.Contains(body, url) {
+		t.Errorf("got %d with body %q, want the block page", response.Code, body)
+	}
+
+	conn = newBufferConn("")
+	err = sendErrorResponse(userSettings, conn, &protocol.Error{protocol.StatusBadGateway, errors.New("test error")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, body = readResponse(t, conn, protocol.MethodGet)
+	if response.Code != protocol.StatusBadGateway || !strings.Contains(body, "test error") {
+		t.Errorf("got %d with body %q, want the error page", response.Code, body)
+	}
+}
+
+func TestCredentialsCheck(t *testing.T) {
+	credentials := &Credentials{
+		hashes:   map[string][]byte{"alice": dummyHash},
+		verified: make(map[[32]byte]bool),
+	}
+	tests := []struct {
+		username, password string
+		want               bool
+	}{
+		{"alice", "dummy password", true},
+		{"alice", "dummy password", true}, // remembered
+		{"alice", "wrong", false},
+		{"bob", "dummy password", false},
+	}
+	for _, test := range tests {
+		if got := credentials.Check(test.username, test.password); got != test.want {
+			t.Errorf("Check(%q, %q) = %v, want %v", test.username, test.password, got, test.want)
+		}
+	}
+}
+
+// writeCredentials writes an htpasswd file with the lines and returns its name
+func writeCredentials(t *testing.T, lines ...string) string {
+	filename := filepath.Join(t.TempDir(), "htpasswd")
+	if err := ioutil.WriteFile(filename, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestLoadCredentials(t *testing.T) {
+	credentials, err := loadCredentials(writeCredentials(t, "# users", "", "alice:"+string(dummyHash)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !credentials.Has("alice") || credentials.Has("bob") {
+		t.Errorf("got users %v", credentials.hashes)
+	}
+
+	for _, line := range []string{"alice", ":" + string(dummyHash), "alice:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g="} {
+		if _, err := loadCredentials(writeCredentials(t, line)); err == nil {
+			t.Errorf("%q is accepted", line)
+		}
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	settings := loadTestSettings(t, map[string]interface{}{
+		"CredentialsFile": writeCredentials(t, "alice:"+string(dummyHash)),
+	})
+	basic := func(credentials string) string {
+		return "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(credentials)) + "\r\n"
+	}
+	tests := []struct {
+		name, header, username string
+		wantErr                bool
+	}{
+		{"valid", basic("alice:dummy password"), "alice", false},
+		{"lowercase scheme", strings.Replace(basic("alice:dummy password"), "Basic", "basic", 1), "alice", false},
+		{"no header", "", "", true},
+		{"wrong password", basic("alice:wrong"), "", true},
+		{"unknown user", basic("bob:dummy password"), "", true},
+		{"no colon", basic("alice"), "", true},
+		{"other scheme", "Proxy-Authorization: Bearer abc\r\n", "", true},
+		{"invalid base64", "Proxy-Authorization: Basic %%%\r\n", "", true},
+	}
+	for _, test := range tests {
+		request := readRequest(t, "GET http://example.com/ HTTP/1.1\r\n"+test.header+"\r\n")
+		username, err := settings.authenticate(request)
+		if username != test.username || (err != nil) != test.wantErr {
+			t.Errorf("%s: got %q, error %v", test.name, username, err)
+		}
+		if _, ok := request.Header("Proxy-Authorization"); ok {
+			t.Errorf("%s: Proxy-Authorization is passed further", test.name)
+		}
+	}
+
+	conn := newBufferConn("GET http://example.com/ HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	protocolErr, _ := handleClient(settings, protocol.NewConn(conn), "")
+	if protocolErr == nil || protocolErr.Status != protocol.StatusProxyAuthRequired {
+		t.Errorf("got %v for a request without credentials", protocolErr)
+	}
+}
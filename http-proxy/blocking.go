@@ -0,0 +1,209 @@
+package main
+
+import (
+	"./protocol"
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync/atomic"
+)
+
+// Actions of request blocking rules
+const (
+	ActionForbidden = "forbidden" // a 403 page rendered from blocked.tpl
+	ActionEmpty     = "empty"     // an empty 204 response
+	ActionGIF       = "gif"       // a transparent 1x1 GIF image
+	ActionStub      = "stub"      // an empty script or stylesheet, depending on the expected content type
+)
+
+type BlockRuleConfig struct {
+	URL, Method, Referer string
+	Action               string
+}
+
+type BlockRule struct {
+	URL, Method, Referer *regexp.Regexp
+	Action               string
+	Text                 string
+}
+
+var (
+	blockedCount int64
+
+	transparentGIF = []byte("GIF89a\x01\x00\x01\x00\x80\x00\x00\x00\x00\x00\x00\x00\x00" +
+		"!\xf9\x04\x01\x00\x00\x00\x00,\x00\x00\x00\x00\x01\x00\x01\x00\x00\x02\x02D\x01\x00;")
+)
+
+func compileOptionalRegexp(expr string) (*regexp.Regexp, error) {
+	if expr == "" {
+		return nil, nil
+	}
+	return regexp.Compile(expr)
+}
+
+func compileBlockRule(ruleConfig BlockRuleConfig) (BlockRule, error) {
+	var conditions []string
+	for _, item := range [][2]string{
+		{"URL", ruleConfig.URL}, {"method", ruleConfig.Method}, {"Referer", ruleConfig.Referer},
+	} {
+		if item[1] != "" {
+			conditions = append(conditions, item[0]+" "+item[1])
+		}
+	}
+	rule := BlockRule{
+		Action: ruleConfig.Action,
+		Text:   fmt.Sprintf("the rule (%s)", strings.Join(conditions, ", ")),
+	}
+	switch rule.Action {
+	case "":
+		rule.Action = ActionForbidden
+	case ActionForbidden, ActionEmpty, ActionGIF, ActionStub:
+	default:
+		return rule, fmt.Errorf("unknown action %s", rule.Action)
+	}
+
+	var err error
+	for _, item := range []struct {
+		expr   string
+		result **regexp.Regexp
+	}{
+		{ruleConfig.URL, &rule.URL},
+		{ruleConfig.Method, &rule.Method},
+		{ruleConfig.Referer, &rule.Referer},
+	} {
+		*item.result, err = compileOptionalRegexp(item.expr)
+		if err != nil {
+			return rule, err
+		}
+	}
+	return rule, nil
+}
+
+func (rule *BlockRule) Matches(url string, request *protocol.Request) bool {
+	if rule.URL != nil && !rule.URL.MatchString(url) {
+		return false
+	}
+	if rule.Method != nil && !rule.Method.MatchString(request.Method) {
+		return false
+	}
+	if rule.Referer != nil {
+		referer, ok := request.Header("Referer")
+		if !ok || !rule.Referer.MatchString(referer) {
+			return false
+		}
+	}
+	return true
+}
+
+// findBlockRule returns the action for a request that mustn't reach the origin and the rule that caused it
+func (settings *Settings) findBlockRule(url string, request *protocol.Request) (string, string, bool) {
+	for _, rule := range settings.blockRules {
+		if rule.Matches(url, request) {
+			return rule.Action, rule.Text, true
+		}
+	}
+	if settings.filterList != nil {
+		if rule := settings.filterList.BlockingRule(url, request); rule != nil {
+			return ActionForbidden, "the filter " + rule.Text, true
+		}
+	}
+	return "", "", false
+}
+
+func stubContentType(rawURL string, request *protocol.Request) string {
+	requestURL, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	switch guessResourceType(request, requestURL) {
+	case typeScript:
+		return "application/javascript"
+	case typeStylesheet:
+		return "text/css"
+	case typeImage:
+		return "image/gif"
+	}
+	return ""
+}
+
+func sendBlockedResponse(settings *Settings, clientConn net.Conn, url string, request *protocol.Request,
+	action, ruleText string, keepAlive bool) error {
+	count := atomic.AddInt64(&blockedCount, 1)
+	log.Printf("blocked %s %s by %s with %s (%d requests blocked in total)\n",
+		request.Method, url, ruleText, action, count)
+
+	response := &protocol.Response{
+		Protocol: "HTTP/1.1",
+		Code:     protocol.StatusOK,
+		MessageBase: protocol.MessageBase{
+			Headers:   defaultResponseHeaders(),
+			KeepAlive: keepAlive,
+		},
+	}
+
+	var body *bytes.Reader
+	contentType := ""
+	if action == ActionStub {
+		contentType = stubContentType(url, request)
+		if contentType == "image/gif" {
+			action = ActionGIF
+		} else if contentType == "" {
+			action = ActionEmpty
+		}
+	}
+	switch action {
+	case ActionForbidden:
+		var page bytes.Buffer
+		err := settings.blockTemplate.Execute(&page, struct {
+			URL, Rule, ServerName string
+			Config
+		}{url, ruleText, ServerName, settings.Config})
+		if err != nil {
+			return err
+		}
+		response.Code = protocol.StatusForbidden
+		contentType = "text/html"
+		body = bytes.NewReader(page.Bytes())
+	case ActionEmpty:
+		response.Code = protocol.StatusNoContent
+	case ActionGIF:
+		contentType = "image/gif"
+		body = bytes.NewReader(transparentGIF)
+	case ActionStub:
+		body = bytes.NewReader(nil)
+	}
+	response.Reason = protocol.StatusText[response.Code]
+
+	if contentType != "" {
+		response.SetHeader("Content-Type", contentType)
+	}
+	if body != nil {
+		response.SetContentLength(body.Size())
+	}
+	// A response to HEAD has the headers of the page only
+	if body != nil && request.Method != protocol.MethodHead {
+		response.Body = protocol.NewPipe()
+		go func() {
+			_, err := io.Copy(response.Body.Writer, body)
+			response.Body.Writer.CloseWithError(err)
+		}()
+	}
+	return response.WriteTo(clientConn)
+}
+
+func compileBlockRules(ruleConfigs []BlockRuleConfig) ([]BlockRule, error) {
+	var rules []BlockRule
+	for _, ruleConfig := range ruleConfigs {
+		rule, err := compileBlockRule(ruleConfig)
+		if err != nil {
+			return nil, fmt.Errorf("can't compile a rule from BlockRequests: %s", err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
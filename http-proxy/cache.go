@@ -0,0 +1,839 @@
+package main
+
+import (
+	"./protocol"
+	"bufio"
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// A tier doesn't take entries bigger than this part of its limit
+	cacheEntryShare = 8
+	// Bodies bigger than this aren't buffered to be cached at all
+	cacheMaxEntrySize = 32 * 1024 * 1024
+	// Heuristic freshness (RFC 7234, section 4.2.2) is capped by this
+	cacheMaxHeuristicLifetime = 24 * time.Hour
+	// Files are written under a name with this prefix and renamed when they are complete
+	cacheTempPrefix = "tmp-"
+)
+
+// Statuses that are cacheable without explicit freshness information (RFC 7231, section 6.1)
+var cacheableByDefault = map[int]bool{
+	200: true, 203: true, 204: true, 300: true, 301: true,
+	404: true, 405: true, 410: true, 414: true, 501: true,
+}
+
+// Other status codes that are stored if the response has an explicit lifetime. Partial (206)
+// and 304 responses aren't complete responses, so they are never stored.
+var cacheableWithLifetime = map[int]bool{
+	302: true, 303: true, 307: true, 308: true,
+}
+
+// cacheEntry is a stored response. Only the body location is modified after the entry is stored,
+// and only while holding the cache mutex.
+type cacheEntry struct {
+	Key     string            // URL, followed by the rule set version if the page is rewritten
+	Variant []protocol.Header // request headers named by Vary, as they were sent with the original request
+	Code    int
+	Reason  string
+	Headers []protocol.Header
+	Size    int64
+
+	ResponseTime time.Time
+	InitialAge   time.Duration // corrected initial age (RFC 7234, section 4.2.3)
+
+	body     []byte // the body if it's kept in memory
+	inMemory bool
+	filename string // the file with the entry if it's kept on disk
+	element  *list.Element
+}
+
+// ResponseCache is a shared HTTP cache (RFC 7234) keeping responses in memory, on disk or both.
+// Both tiers share one LRU order: the least recently used entries leave memory first,
+// but stay on disk if it's enabled.
+type ResponseCache struct {
+	MemoryLimit, DiskLimit int64 // bytes, zero disables a tier
+	Dir                    string
+
+	mutex      sync.Mutex
+	lru        *list.List // the front is the most recently used entry
+	variants   map[string][]*cacheEntry
+	memorySize int64
+	diskSize   int64
+}
+
+// responseCache is nil if caching is disabled
+var responseCache *ResponseCache
+
+func NewResponseCache(memoryLimit, diskLimit int64, dir string) (*ResponseCache, error) {
+	cache := &ResponseCache{
+		MemoryLimit: memoryLimit,
+		DiskLimit:   diskLimit,
+		Dir:         dir,
+		lru:         list.New(),
+		variants:    make(map[string][]*cacheEntry),
+	}
+	if diskLimit > 0 {
+		err := cache.loadDir()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return cache, nil
+}
+
+// loadDir indexes the entries left on disk by a previous run
+func (cache *ResponseCache) loadDir() error {
+	err := os.MkdirAll(cache.Dir, 0700)
+	if err != nil {
+		return err
+	}
+	infos, err := ioutil.ReadDir(cache.Dir)
+	if err != nil {
+		return err
+	}
+	// The modification time of a file is the time it was used last
+	sort.Slice(infos, func(i, j int) bool { return infos[i].ModTime().After(infos[j].ModTime()) })
+
+	for _, info := range infos {
+		filename := path.Join(cache.Dir, info.Name())
+		if strings.HasPrefix(info.Name(), cacheTempPrefix) {
+			// The previous run stopped while writing the file
+			os.Remove(filename)
+			continue
+		}
+		entry, err := readEntryHeader(filename, info.Size())
+		if err != nil {
+			log.Printf("removing a broken cache file %s: %s\n", filename, err)
+			os.Remove(filename)
+			continue
+		}
+		if cache.findVariant(entry.Key, entry.Variant) != nil {
+			// A newer file for the same variant was already indexed
+			os.Remove(filename)
+			continue
+		}
+		entry.filename = filename
+		entry.element = cache.lru.PushBack(entry)
+		cache.variants[entry.Key] = append(cache.variants[entry.Key], entry)
+		cache.diskSize += entry.Size
+	}
+	cache.evict()
+	log.Printf("cache loaded: %d entries, %d bytes on disk\n", cache.lru.Len(), cache.diskSize)
+	return nil
+}
+
+// readEntryHeader reads the entry from a file and checks that the body after it is complete
+func readEntryHeader(filename string, fileSize int64) (*cacheEntry, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	entry := new(cacheEntry)
+	line, err := bufio.NewReader(file).ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(line, entry)
+	if err != nil {
+		return nil, err
+	}
+	if bodySize := fileSize - int64(len(line)); bodySize != entry.Size {
+		return nil, fmt.Errorf("the body has %d bytes instead of %d", bodySize, entry.Size)
+	}
+	return entry, nil
+}
+
+// writeEntryFile stores an entry as a line of JSON followed by the body
+func (cache *ResponseCache) writeEntryFile(entry *cacheEntry, body []byte) (string, error) {
+	header, err := json.Marshal(entry)
+	if err != nil {
+		return "", err
+	}
+	file, err := ioutil.TempFile(cache.Dir, cacheTempPrefix)
+	if err != nil {
+		return "", err
+	}
+	_, err = file.Write(append(header, '\n'))
+	if err == nil {
+		_, err = file.Write(body)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+
+	// Every stored entry gets its own file, so evicting an old entry can't remove a new one
+	hash := sha256.Sum256([]byte(entry.Key))
+	filename := path.Join(cache.Dir, fmt.Sprintf("%s-%d", hex.EncodeToString(hash[:8]), time.Now().UnixNano()))
+	err = os.Rename(file.Name(), filename)
+	if err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return filename, nil
+}
+
+func variantMatches(variant []protocol.Header, request *protocol.Request) bool {
+	for _, header := range variant {
+		value, _ := request.Header(header.Key)
+		if normalizeHeaderValue(value) != header.Value {
+			return false
+		}
+	}
+	return true
+}
+
+func normalizeHeaderValue(value string) string {
+	return strings.Join(strings.Fields(value), " ")
+}
+
+func sameVariant(a, b []protocol.Header) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !strings.EqualFold(a[i].Key, b[i].Key) || a[i].Value != b[i].Value {
+			return false
+		}
+	}
+	return true
+}
+
+func (cache *ResponseCache) findVariant(key string, variant []protocol.Header) *cacheEntry {
+	for _, entry := range cache.variants[key] {
+		if sameVariant(entry.Variant, variant) {
+			return entry
+		}
+	}
+	return nil
+}
+
+func (cache *ResponseCache) remove(entry *cacheEntry) {
+	if entry.inMemory {
+		cache.memorySize -= entry.Size
+	}
+	if entry.filename != "" {
+		os.Remove(entry.filename)
+		cache.diskSize -= entry.Size
+	}
+	cache.lru.Remove(entry.element)
+
+	variants := cache.variants[entry.Key]
+	for i, item := range variants {
+		if item == entry {
+			variants = append(variants[:i], variants[i+1:]...)
+			break
+		}
+	}
+	if len(variants) == 0 {
+		delete(cache.variants, entry.Key)
+	} else {
+		cache.variants[entry.Key] = variants
+	}
+}
+
+// evict drops the least recently used bodies from the tiers that exceed their limits
+func (cache *ResponseCache) evict() {
+	var previous *list.Element
+	for element := cache.lru.Back(); element != nil; element = previous {
+		if cache.memorySize <= cache.MemoryLimit && cache.diskSize <= cache.DiskLimit {
+			return
+		}
+		previous = element.Prev()
+		entry := element.Value.(*cacheEntry)
+		if cache.memorySize > cache.MemoryLimit && entry.inMemory {
+			entry.body = nil
+			entry.inMemory = false
+			cache.memorySize -= entry.Size
+		}
+		if cache.diskSize > cache.DiskLimit && entry.filename != "" {
+			os.Remove(entry.filename)
+			entry.filename = ""
+			cache.diskSize -= entry.Size
+		}
+		if !entry.inMemory && entry.filename == "" {
+			cache.remove(entry)
+		}
+	}
+}
+
+func (cache *ResponseCache) store(entry *cacheEntry, body []byte) {
+	if cache.DiskLimit > 0 && entry.Size <= cache.DiskLimit/cacheEntryShare {
+		filename, err := cache.writeEntryFile(entry, body)
+		if err != nil {
+			log.Println("can't write a cache file: " + err.Error())
+		} else {
+			entry.filename = filename
+		}
+	}
+	if cache.MemoryLimit > 0 && entry.Size <= cache.MemoryLimit/cacheEntryShare {
+		entry.body = body
+		entry.inMemory = true
+	}
+	if !entry.inMemory && entry.filename == "" {
+		return
+	}
+
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	if old := cache.findVariant(entry.Key, entry.Variant); old != nil {
+		cache.remove(old)
+	}
+	entry.element = cache.lru.PushFront(entry)
+	cache.variants[entry.Key] = append(cache.variants[entry.Key], entry)
+	if entry.inMemory {
+		cache.memorySize += entry.Size
+	}
+	if entry.filename != "" {
+		cache.diskSize += entry.Size
+	}
+	cache.evict()
+}
+
+// Invalidate removes all stored responses for a key, which is required
+// after a successful unsafe request to the URL (RFC 7234, section 4.4).
+func (cache *ResponseCache) Invalidate(key string) {
+	if cache == nil {
+		return
+	}
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+
+	for _, entry := range append([]*cacheEntry(nil), cache.variants[key]...) {
+		cache.remove(entry)
+	}
+}
+
+// CachedResponse is a stored response selected for a request with its body opened
+type CachedResponse struct {
+	entry *cacheEntry
+	body  io.ReadCloser
+
+	// The request was made conditional by AddValidators, so its conditions aren't the client's
+	revalidating bool
+}
+
+// Lookup finds a stored response matching the request, fresh or not
+func (cache *ResponseCache) Lookup(key string, request *protocol.Request) *CachedResponse {
+	if cache == nil || request.Method != protocol.MethodGet && request.Method != protocol.MethodHead {
+		return nil
+	}
+	if cacheControl(&request.MessageBase)["no-store"] != nil {
+		return nil
+	}
+
+	cache.mutex.Lock()
+	var entry *cacheEntry
+	for _, item := range cache.variants[key] {
+		if variantMatches(item.Variant, request) {
+			entry = item
+			break
+		}
+	}
+	if entry == nil {
+		cache.mutex.Unlock()
+		return nil
+	}
+	cache.lru.MoveToFront(entry.element)
+	body, inMemory, filename := entry.body, entry.inMemory, entry.filename
+	cache.mutex.Unlock()
+
+	if inMemory {
+		return &CachedResponse{entry: entry, body: ioutil.NopCloser(bytes.NewReader(body))}
+	}
+
+	// The file may be already evicted, then the response has to be fetched again
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil
+	}
+	now := time.Now()
+	os.Chtimes(filename, now, now)
+	reader := bufio.NewReader(file)
+	_, err = reader.ReadBytes('\n')
+	if err != nil {
+		file.Close()
+		return nil
+	}
+	return &CachedResponse{entry: entry, body: struct {
+		io.Reader
+		io.Closer
+	}{reader, file}}
+}
+
+func (cached *CachedResponse) Close() error {
+	return cached.body.Close()
+}
+
+// cacheControl parses the Cache-Control directives of a message. Directives without an argument get an empty value.
+func cacheControl(message *protocol.MessageBase) map[string]*string {
+	directives := make(map[string]*string)
+	value, ok := message.Header("Cache-Control")
+	if !ok {
+		return directives
+	}
+	for _, item := range strings.Split(value, ",") {
+		parts := strings.SplitN(strings.TrimSpace(item), "=", 2)
+		name := strings.ToLower(parts[0])
+		if name == "" {
+			continue
+		}
+		argument := ""
+		if len(parts) == 2 {
+			argument = strings.Trim(parts[1], `"`)
+		}
+		directives[name] = &argument
+	}
+	return directives
+}
+
+// deltaSeconds parses the argument of a directive like max-age
+func deltaSeconds(directives map[string]*string, name string) (time.Duration, bool) {
+	argument := directives[name]
+	if argument == nil {
+		return 0, false
+	}
+	seconds, err := strconv.ParseInt(*argument, 10, 32)
+	if err != nil || seconds < 0 {
+		// An invalid value makes the response stale
+		return 0, true
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+var httpDateLayouts = []string{time.RFC1123, time.RFC850, time.ANSIC}
+
+func parseHTTPDate(value string) (time.Time, bool) {
+	for _, layout := range httpDateLayouts {
+		if result, err := time.Parse(layout, value); err == nil {
+			return result, true
+		}
+	}
+	return time.Time{}, false
+}
+
+func headerDate(message *protocol.MessageBase, key string) (time.Time, bool) {
+	value, ok := message.Header(key)
+	if !ok {
+		return time.Time{}, false
+	}
+	return parseHTTPDate(value)
+}
+
+// explicitLifetime returns the freshness lifetime given by the origin (RFC 7234, section 4.2.1)
+func explicitLifetime(message *protocol.MessageBase) (time.Duration, bool) {
+	directives := cacheControl(message)
+	if lifetime, ok := deltaSeconds(directives, "s-maxage"); ok {
+		return lifetime, true
+	}
+	if lifetime, ok := deltaSeconds(directives, "max-age"); ok {
+		return lifetime, true
+	}
+	if value, ok := message.Header("Expires"); ok {
+		expires, ok := parseHTTPDate(value)
+		if !ok {
+			return 0, true
+		}
+		date, ok := headerDate(message, "Date")
+		if !ok {
+			return 0, true
+		}
+		return expires.Sub(date), true
+	}
+	return 0, false
+}
+
+func (entry *cacheEntry) message() *protocol.MessageBase {
+	return &protocol.MessageBase{Headers: entry.Headers}
+}
+
+func (entry *cacheEntry) freshnessLifetime() time.Duration {
+	message := entry.message()
+	if lifetime, ok := explicitLifetime(message); ok {
+		return lifetime
+	}
+	if !cacheableByDefault[entry.Code] {
+		return 0
+	}
+	lastModified, ok := headerDate(message, "Last-Modified")
+	date, dateOk := headerDate(message, "Date")
+	if !ok || !dateOk || !lastModified.Before(date) {
+		return 0
+	}
+	lifetime := date.Sub(lastModified) / 10
+	if lifetime > cacheMaxHeuristicLifetime {
+		lifetime = cacheMaxHeuristicLifetime
+	}
+	return lifetime
+}
+
+func (entry *cacheEntry) age(now time.Time) time.Duration {
+	return entry.InitialAge + now.Sub(entry.ResponseTime)
+}
+
+// Fresh tells whether the response can be sent without asking the origin
+func (cached *CachedResponse) Fresh(request *protocol.Request, now time.Time) bool {
+	entry := cached.entry
+	requestDirectives := cacheControl(&request.MessageBase)
+	if requestDirectives["no-cache"] != nil || cacheControl(entry.message())["no-cache"] != nil {
+		return false
+	}
+	if pragma, ok := request.Header("Pragma"); ok && strings.Contains(strings.ToLower(pragma), "no-cache") {
+		return false
+	}
+	age := entry.age(now)
+	if maxAge, ok := deltaSeconds(requestDirectives, "max-age"); ok && age > maxAge {
+		return false
+	}
+	return age < entry.freshnessLifetime()
+}
+
+func hasConditions(request *protocol.Request) bool {
+	for _, key := range []string{"If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since", "If-Range"} {
+		if _, ok := request.Header(key); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// AddValidators makes the request conditional, so the origin may confirm that the stored response is still valid.
+// It returns false if the response can't be revalidated for the request.
+func (cached *CachedResponse) AddValidators(request *protocol.Request) bool {
+	if hasConditions(request) {
+		// The client validates its own copy, the answer is for it
+		return false
+	}
+	message := cached.entry.message()
+	etag, hasETag := message.Header("ETag")
+	lastModified, hasLastModified := message.Header("Last-Modified")
+	if hasETag {
+		request.SetHeader("If-None-Match", etag)
+	}
+	if hasLastModified {
+		request.SetHeader("If-Modified-Since", lastModified)
+	}
+	cached.revalidating = hasETag || hasLastModified
+	return cached.revalidating
+}
+
+func weakETag(etag string) string {
+	return strings.TrimPrefix(strings.TrimSpace(etag), "W/")
+}
+
+// notModified evaluates the conditions of a request against a fresh stored response (RFC 7232, section 6)
+func (entry *cacheEntry) notModified(request *protocol.Request) bool {
+	message := entry.message()
+	if value, ok := request.Header("If-None-Match"); ok {
+		etag, ok := message.Header("ETag")
+		if !ok {
+			return false
+		}
+		for _, item := range strings.Split(value, ",") {
+			item = strings.TrimSpace(item)
+			if item == "*" || weakETag(item) == weakETag(etag) {
+				return true
+			}
+		}
+		return false
+	}
+	if since, ok := headerDate(&request.MessageBase, "If-Modified-Since"); ok {
+		lastModified, ok := headerDate(message, "Last-Modified")
+		return ok && !lastModified.After(since)
+	}
+	return false
+}
+
+// Response makes a response to be sent to the client. The response owns the opened body.
+func (cached *CachedResponse) Response(request *protocol.Request, now time.Time) *protocol.Response {
+	entry := cached.entry
+	response := &protocol.Response{
+		Protocol: "HTTP/1.1",
+		Code:     entry.Code,
+		Reason:   entry.Reason,
+		MessageBase: protocol.MessageBase{
+			Headers: append([]protocol.Header(nil), entry.Headers...),
+		},
+	}
+	response.SetHeader("Age", strconv.FormatInt(int64(entry.age(now)/time.Second), 10))
+
+	if !cached.revalidating && hasConditions(request) && entry.notModified(request) {
+		cached.Close()
+		response.Code = protocol.StatusNotModified
+		response.Reason = protocol.StatusText[protocol.StatusNotModified]
+		return response
+	}
+	if entry.Code != protocol.StatusNoContent {
+		response.SetContentLength(entry.Size)
+	}
+	if request.Method == protocol.MethodHead || entry.Size == 0 {
+		cached.Close()
+		return response
+	}
+
+	body := protocol.NewPipe()
+	response.Body = body
+	go func() {
+		defer cached.Close()
+		_, err := io.Copy(body.Writer, cached.body)
+		body.Writer.CloseWithError(err)
+	}()
+	return response
+}
+
+// Hop-by-hop headers and headers describing the transfer aren't stored
+var unstoredHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Connection", "Proxy-Authenticate", "TE", "Trailer",
+	"Transfer-Encoding", "Upgrade", "Content-Length", "Age",
+}
+
+func storedHeaders(response *protocol.Response) []protocol.Header {
+	message := protocol.MessageBase{Headers: append([]protocol.Header(nil), response.Headers...)}
+	if value, ok := message.Header("Connection"); ok {
+		for _, item := range strings.Split(value, ",") {
+			message.DeleteHeader(strings.TrimSpace(item))
+		}
+	}
+	for _, key := range unstoredHeaders {
+		message.DeleteHeader(key)
+	}
+	return message.Headers
+}
+
+// Revalidated updates a stored response with the headers of a 304 response from the origin (RFC 7234, section 4.3.4)
+func (cache *ResponseCache) Revalidated(cached *CachedResponse, notModified *protocol.Response,
+	requestTime, responseTime time.Time) (*CachedResponse, error) {
+
+	body, err := ioutil.ReadAll(io.LimitReader(cached.body, cached.entry.Size))
+	cached.Close()
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) != cached.entry.Size {
+		return nil, errors.New("cached body is truncated")
+	}
+
+	updated := *cached.entry
+	message := updated.message()
+	message.Headers = append([]protocol.Header(nil), message.Headers...)
+	for _, header := range storedHeaders(notModified) {
+		message.SetHeader(header.Key, header.Value)
+	}
+	updated.Headers = message.Headers
+	updated.ResponseTime = responseTime
+	updated.InitialAge = initialAge(&notModified.MessageBase, requestTime, responseTime)
+	updated.body, updated.inMemory, updated.filename, updated.element = nil, false, "", nil
+
+	cache.store(&updated, body)
+	return &CachedResponse{&updated, ioutil.NopCloser(bytes.NewReader(body)), true}, nil
+}
+
+// initialAge calculates the age of a response when it was received (RFC 7234, section 4.2.3)
+func initialAge(message *protocol.MessageBase, requestTime, responseTime time.Time) time.Duration {
+	var apparentAge time.Duration
+	if date, ok := headerDate(message, "Date"); ok && responseTime.After(date) {
+		apparentAge = responseTime.Sub(date)
+	}
+	var ageValue time.Duration
+	if value, ok := message.Header("Age"); ok {
+		if seconds, err := strconv.ParseInt(strings.TrimSpace(value), 10, 32); err == nil && seconds > 0 {
+			ageValue = time.Duration(seconds) * time.Second
+		}
+	}
+	correctedAge := ageValue + responseTime.Sub(requestTime)
+	if apparentAge > correctedAge {
+		return apparentAge
+	}
+	return correctedAge
+}
+
+// storable tells whether a shared cache may store a response (RFC 7234, section 3)
+func storable(request *protocol.Request, response *protocol.Response) bool {
+	if request.Method != protocol.MethodGet {
+		return false
+	}
+	if _, ok := request.Header("Range"); ok {
+		return false
+	}
+	requestDirectives := cacheControl(&request.MessageBase)
+	responseDirectives := cacheControl(&response.MessageBase)
+	if requestDirectives["no-store"] != nil || responseDirectives["no-store"] != nil ||
+		responseDirectives["private"] != nil {
+		return false
+	}
+	if _, ok := request.Header("Authorization"); ok && responseDirectives["public"] == nil &&
+		responseDirectives["must-revalidate"] == nil && responseDirectives["s-maxage"] == nil {
+		return false
+	}
+	// Cookies of one user shouldn't be handed out to others
+	if _, ok := response.Header("Set-Cookie"); ok {
+		return false
+	}
+	if vary, ok := response.Header("Vary"); ok && strings.Contains(vary, "*") {
+		return false
+	}
+	// Other transfer codings would be stored undecoded
+	if value, ok := response.Header("Transfer-Encoding"); ok && !strings.EqualFold(strings.TrimSpace(value), "chunked") {
+		return false
+	}
+	if !response.Delimited() {
+		return false
+	}
+
+	lifetime, explicit := explicitLifetime(&response.MessageBase)
+	if !cacheableByDefault[response.Code] && !(explicit && cacheableWithLifetime[response.Code]) {
+		return false
+	}
+	_, hasETag := response.Header("ETag")
+	_, hasLastModified := response.Header("Last-Modified")
+	// A response that is stale at once and can't be revalidated is useless
+	return lifetime > 0 || hasETag || hasLastModified
+}
+
+func variantOf(request *protocol.Request, response *protocol.Response) []protocol.Header {
+	vary, ok := response.Header("Vary")
+	if !ok {
+		return nil
+	}
+	var variant []protocol.Header
+	for _, key := range strings.Split(vary, ",") {
+		key = strings.TrimSpace(key)
+		if key == "" {
+			continue
+		}
+		value, _ := request.Header(key)
+		variant = append(variant, protocol.Header{key, normalizeHeaderValue(value)})
+	}
+	return variant
+}
+
+// Capture stores a response once its body is passed to the client completely.
+// It has to be called before the response headers are rewritten for the client.
+func (cache *ResponseCache) Capture(key string, request *protocol.Request, response *protocol.Response,
+	requestTime, responseTime time.Time) {
+
+	if cache == nil || !storable(request, response) {
+		return
+	}
+	entry := &cacheEntry{
+		Key:          key,
+		Variant:      variantOf(request, response),
+		Code:         response.Code,
+		Reason:       response.Reason,
+		Headers:      storedHeaders(response),
+		ResponseTime: responseTime,
+		InitialAge:   initialAge(&response.MessageBase, requestTime, responseTime),
+	}
+	if response.Body == nil {
+		cache.store(entry, nil)
+		return
+	}
+
+	original, captured := response.Body, protocol.NewPipe()
+	response.Body = captured
+	go func() {
+		var body bytes.Buffer
+		tooBig := false
+		buffer := make([]byte, 32*1024)
+		var err error
+		for {
+			var n int
+			n, err = original.Reader.Read(buffer)
+			if n > 0 {
+				if _, writeErr := captured.Writer.Write(buffer[:n]); writeErr != nil {
+					original.Reader.CloseWithError(writeErr)
+					return
+				}
+				if !tooBig && body.Len()+n <= cacheMaxEntrySize {
+					body.Write(buffer[:n])
+				} else {
+					tooBig = true
+					body.Reset()
+				}
+			}
+			if err != nil {
+				break
+			}
+		}
+		if err != io.EOF {
+			captured.Writer.CloseWithError(err)
+			return
+		}
+		captured.Writer.Close()
+		if !tooBig {
+			// Cached responses are served with Content-Length, so the trailers become headers
+			entry.Headers = append(entry.Headers, protocol.AllowedTrailers(response.Trailers())...)
+			entry.Size = int64(body.Len())
+			cache.store(entry, body.Bytes())
+		}
+	}()
+}
+
+// cacheKey includes the rule set version for rewritten pages,
+// so the pages rewritten by the old rules aren't used after a reload.
+func (settings *Settings) cacheKey(url string, rules []URLRule) string {
+	if rules != nil {
+		return url + " rules=" + settings.rulesVersion
+	}
+	return url
+}
+
+// rulesVersion identifies the rules that rewrite pages, including the content of the filter lists
+func rulesVersion(config *Config) (string, error) {
+	hash := sha256.New()
+	rules, err := json.Marshal([]interface{}{config.RemoveElements, config.InjectElements})
+	if err != nil {
+		return "", err
+	}
+	hash.Write(rules)
+	for _, filename := range config.FilterLists {
+		content, err := ioutil.ReadFile(resolveConfigPath(filename))
+		if err != nil {
+			return "", err
+		}
+		hash.Write(content)
+	}
+	return hex.EncodeToString(hash.Sum(nil)[:8]), nil
+}
+
+func sendCachedResponse(settings *Settings, clientConn net.Conn, url string, request *protocol.Request,
+	response *protocol.Response, keepAlive bool) (*protocol.Error, connState) {
+
+	settings.rewriteHeaders(url, request, response)
+	response.KeepAlive = keepAlive
+	err := response.WriteTo(clientConn)
+	if err != nil {
+		if response.Body != nil {
+			response.Body.Reader.CloseWithError(err)
+		}
+		return &protocol.Error{0, err}, connClose
+	}
+	if !keepAlive || request.DiscardBody() != nil {
+		return nil, connClose
+	}
+	return nil, connKeepAlive
+}
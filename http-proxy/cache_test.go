@@ -0,0 +1,277 @@
+package main
+
+import (
+	"./protocol"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestCacheLoadDir(t *testing.T) {
+	dir := t.TempDir()
+	cache, err := NewResponseCache(0, 1<<20, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.store(&cacheEntry{Key: "http://example.com/complete", Code: 200, Size: 5}, []byte("hello"))
+	cache.store(&cacheEntry{Key: "http://example.com/truncated", Code: 200, Size: 5}, []byte("hello"))
+	truncated := cache.variants["http://example.com/truncated"][0].filename
+	info, err := os.Stat(truncated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(truncated, info.Size()-2); err != nil {
+		t.Fatal(err)
+	}
+	// A file that wasn't renamed yet when the previous run stopped
+	partial := path.Join(dir, cacheTempPrefix+"123")
+	if err := ioutil.WriteFile(partial, []byte(`{"Key":"http://example.com/partial","Code":200,"Size":5}`+"\nhello"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	broken := path.Join(dir, "broken")
+	if err := ioutil.WriteFile(broken, []byte("{\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cache, err = NewResponseCache(0, 1<<20, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cache.lru.Len() != 1 || cache.variants["http://example.com/complete"] == nil {
+		t.Errorf("got %d entries, want only the complete one", cache.lru.Len())
+	}
+	if cache.diskSize != 5 {
+		t.Errorf("got disk size %d, want 5", cache.diskSize)
+	}
+	for _, filename := range []string{truncated, partial, broken} {
+		if _, err := os.Stat(filename); !os.IsNotExist(err) {
+			t.Errorf("%s isn't removed", filename)
+		}
+	}
+
+	cached := cache.Lookup("http://example.com/complete", readRequest(t, "GET / HTTP/1.1\r\n\r\n"))
+	if cached == nil {
+		t.Fatal("the loaded entry isn't found")
+	}
+	defer cached.Close()
+	body, err := ioutil.ReadAll(cached.body)
+	if err != nil || string(body) != "hello" {
+		t.Errorf("got body %q, error %v", body, err)
+	}
+}
+
+// readOriginResponse parses a response of an origin to a GET request
+func readOriginResponse(t *testing.T, data string) *protocol.Response {
+	response := new(protocol.Response)
+	if err := response.ReadFrom(newBufferConn(data), protocol.MethodGet); err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+func TestStorable(t *testing.T) {
+	const lifetime = "Cache-Control: max-age=60\r\n"
+	tests := []struct {
+		name            string
+		method, request string // request headers
+		status, headers string
+		want            bool
+	}{
+		{"max-age", "GET", "", "200 OK", lifetime, true},
+		{"validator only", "GET", "", "200 OK", "ETag: \"a\"\r\n", true},
+		{"nothing to check the freshness by", "GET", "", "200 OK", "", false},
+		{"POST", "POST", "", "200 OK", lifetime, false},
+		{"Range", "GET", "Range: bytes=0-1\r\n", "200 OK", lifetime, false},
+		{"no-store in the request", "GET", "Cache-Control: no-store\r\n", "200 OK", lifetime, false},
+		{"private", "GET", "", "200 OK", "Cache-Control: private, max-age=60\r\n", false},
+		{"Authorization", "GET", "Authorization: Basic YTpi\r\n", "200 OK", lifetime, false},
+		{"Authorization with public", "GET", "Authorization: Basic YTpi\r\n", "200 OK",
+			"Cache-Control: public, max-age=60\r\n", true},
+		{"Set-Cookie", "GET", "", "200 OK", lifetime + "Set-Cookie: a=b\r\n", false},
+		{"Vary: *", "GET", "", "200 OK", lifetime + "Vary: *\r\n", false},
+		{"206", "GET", "", "206 Partial Content", lifetime, false},
+		{"302 with a lifetime", "GET", "", "302 Found", lifetime, true},
+		{"302 with a validator", "GET", "", "302 Found", "ETag: \"a\"\r\n", false},
+	}
+	for _, test := range tests {
+		request := readRequest(t, test.method+" / HTTP/1.1\r\nContent-Length: 0\r\n"+test.request+"\r\n")
+		response := readOriginResponse(t, "HTTP/1.1 "+test.status+"\r\n"+test.headers+"Content-Length: 0\r\n\r\n")
+		if got := storable(request, response); got != test.want {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+
+	request := readRequest(t, "GET / HTTP/1.1\r\n\r\n")
+	if storable(request, readOriginResponse(t, "HTTP/1.1 200 OK\r\n"+lifetime+"\r\nbody")) {
+		t.Error("a response delimited by closing the connection is stored")
+	}
+}
+
+func TestFreshness(t *testing.T) {
+	now := time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	date := now.Add(-time.Hour).Format(time.RFC1123)
+	tests := []struct {
+		name    string
+		headers []protocol.Header
+		request string
+		age     time.Duration
+		want    bool
+	}{
+		{"max-age", []protocol.Header{{"Cache-Control", "max-age=60"}}, "", 30 * time.Second, true},
+		{"max-age exceeded", []protocol.Header{{"Cache-Control", "max-age=60"}}, "", 90 * time.Second, false},
+		{"s-maxage over max-age", []protocol.Header{{"Cache-Control", "max-age=10, s-maxage=60"}}, "", 30 * time.Second, true},
+		{"invalid max-age", []protocol.Header{{"Cache-Control", "max-age=x"}}, "", 0, false},
+		{"Expires", []protocol.Header{{"Date", date}, {"Expires", now.Format(time.RFC1123)}}, "", 30 * time.Minute, true},
+		{"invalid Expires", []protocol.Header{{"Date", date}, {"Expires", "0"}}, "", 0, false},
+		{"heuristic", []protocol.Header{{"Date", date},
+			{"Last-Modified", now.Add(-11 * time.Hour).Format(time.RFC1123)}}, "", 30 * time.Minute, true},
+		{"heuristic exceeded", []protocol.Header{{"Date", date},
+			{"Last-Modified", now.Add(-11 * time.Hour).Format(time.RFC1123)}}, "", 90 * time.Minute, false},
+		{"no-cache in the response", []protocol.Header{{"Cache-Control", "max-age=60, no-cache"}}, "", 0, false},
+		{"no-cache in the request", []protocol.Header{{"Cache-Control", "max-age=60"}}, "Cache-Control: no-cache\r\n", 0, false},
+		{"Pragma", []protocol.Header{{"Cache-Control", "max-age=60"}}, "Pragma: no-cache\r\n", 0, false},
+		{"max-age of the request", []protocol.Header{{"Cache-Control", "max-age=60"}}, "Cache-Control: max-age=10\r\n", 30 * time.Second, false},
+	}
+	for _, test := range tests {
+		entry := &cacheEntry{Code: 200, Headers: test.headers, ResponseTime: now.Add(-test.age)}
+		request := readRequest(t, "GET / HTTP/1.1\r\n"+test.request+"\r\n")
+		if got := (&CachedResponse{entry: entry}).Fresh(request, now); got != test.want {
+			t.Errorf("%s: got fresh %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+// captureResponse passes a response through Capture as the proxy does and waits until it's stored
+func captureResponse(t *testing.T, cache *ResponseCache, key string, request *protocol.Request, data string) {
+	response := readOriginResponse(t, data)
+	now := time.Now()
+	cache.Capture(key, request, response, now, now)
+	if response.Body != nil {
+		if _, err := ioutil.ReadAll(response.Body.Reader); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 100 && cache.Lookup(key, request) == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// sendCached makes the response for a request from a stored one and returns its code and body
+func sendCached(t *testing.T, cached *CachedResponse, request *protocol.Request) (*protocol.Response, string) {
+	response := cached.Response(request, time.Now())
+	if response.Body == nil {
+		return response, ""
+	}
+	body, err := ioutil.ReadAll(response.Body.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response, string(body)
+}
+
+func TestCacheVariants(t *testing.T) {
+	cache, err := NewResponseCache(1<<20, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := "http://example.com/"
+	gzipRequest := readRequest(t, "GET / HTTP/1.1\r\nAccept-Encoding:  gzip\r\n\r\n")
+	captureResponse(t, cache, key, gzipRequest, "HTTP/1.1 200 OK\r\nCache-Control: max-age=60\r\n"+
+		"Vary: Accept-Encoding\r\nTransfer-Encoding: chunked\r\n\r\n3\r\ngz!\r\n0\r\nX-Checksum: a\r\n\r\n")
+
+	cached := cache.Lookup(key, readRequest(t, "GET / HTTP/1.1\r\nAccept-Encoding: gzip\r\n\r\n"))
+	if cached == nil {
+		t.Fatal("the stored response isn't found")
+	}
+	response, body := sendCached(t, cached, gzipRequest)
+	if body != "gz!" {
+		t.Errorf("got body %q", body)
+	}
+	if value, _ := response.Header("Content-Length"); value != "3" {
+		t.Errorf("got Content-Length %q", value)
+	}
+	if value, _ := response.Header("X-Checksum"); value != "a" {
+		t.Errorf("the trailer isn't stored as a header: %q", response.Headers)
+	}
+	if _, ok := response.Header("Transfer-Encoding"); ok {
+		t.Error("Transfer-Encoding is stored")
+	}
+
+	if cache.Lookup(key, readRequest(t, "GET / HTTP/1.1\r\n\r\n")) != nil {
+		t.Error("a response is found for another variant")
+	}
+	if cache.Lookup(key, readRequest(t, "HEAD / HTTP/1.1\r\nAccept-Encoding: gzip\r\n\r\n")) == nil {
+		t.Error("a stored response isn't found for HEAD")
+	}
+	cache.Invalidate(key)
+	if cache.Lookup(key, gzipRequest) != nil {
+		t.Error("the response is found after Invalidate")
+	}
+}
+
+func TestCacheRevalidation(t *testing.T) {
+	cache, err := NewResponseCache(1<<20, 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := "http://example.com/"
+	request := readRequest(t, "GET / HTTP/1.1\r\n\r\n")
+	captureResponse(t, cache, key, request, "HTTP/1.1 200 OK\r\nCache-Control: max-age=0\r\n"+
+		"ETag: \"v1\"\r\nX-Version: 1\r\nContent-Length: 5\r\n\r\nhello")
+
+	cached := cache.Lookup(key, request)
+	if cached == nil {
+		t.Fatal("the stored response isn't found")
+	}
+	if cached.Fresh(request, time.Now().Add(time.Second)) {
+		t.Error("a response with max-age=0 is fresh")
+	}
+	if !cached.AddValidators(request) {
+		t.Fatal("a response with ETag can't be revalidated")
+	}
+	if value, _ := request.Header("If-None-Match"); value != `"v1"` {
+		t.Errorf("got If-None-Match %q", value)
+	}
+
+	now := time.Now()
+	notModified := readOriginResponse(t, "HTTP/1.1 304 Not Modified\r\nCache-Control: max-age=60\r\n"+
+		"ETag: \"v1\"\r\nX-Version: 2\r\nContent-Length: 100\r\n\r\n")
+	updated, err := cache.Revalidated(cached, notModified, now, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !updated.Fresh(readRequest(t, "GET / HTTP/1.1\r\n\r\n"), now.Add(time.Second)) {
+		t.Error("the revalidated response isn't fresh")
+	}
+	// The conditions added by AddValidators aren't the client's, so the full response is sent
+	response, body := sendCached(t, updated, request)
+	if response.Code != 200 || body != "hello" {
+		t.Errorf("got %d with body %q", response.Code, body)
+	}
+	if value, _ := response.Header("X-Version"); value != "2" {
+		t.Errorf("the headers aren't updated: %q", response.Headers)
+	}
+	if value, _ := response.Header("Content-Length"); value != "5" {
+		t.Errorf("got Content-Length %q", value)
+	}
+
+	// The next lookup gets the updated entry, and a client with its own copy gets 304
+	conditional := readRequest(t, "GET / HTTP/1.1\r\nIf-None-Match: W/\"v1\"\r\n\r\n")
+	cached = cache.Lookup(key, conditional)
+	if cached == nil || !cached.Fresh(conditional, time.Now()) {
+		t.Fatal("the updated response isn't stored")
+	}
+	if cached.AddValidators(conditional) {
+		t.Error("the conditions of the client are replaced")
+	}
+	if response, _ := sendCached(t, cached, conditional); response.Code != protocol.StatusNotModified {
+		t.Errorf("got %d for a matching If-None-Match", response.Code)
+	}
+	cached = cache.Lookup(key, request)
+	other := readRequest(t, "GET / HTTP/1.1\r\nIf-None-Match: \"v0\"\r\n\r\n")
+	if response, body := sendCached(t, cached, other); response.Code != 200 || body != "hello" {
+		t.Errorf("got %d with body %q for another ETag", response.Code, body)
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"./protocol"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// How long to wait before accepting again after a failure, such as running out of file descriptors
+const acceptRetryDelay = 100 * time.Millisecond
+
+// timeoutConn is a connection that fails reads and writes after the idle timeout without progress.
+// Deadlines set explicitly, such as the one for the headers of a request, override the idle timeout.
+type timeoutConn struct {
+	net.Conn
+	tracker *ConnTracker // nil for connections to servers
+	client  string       // the IP address of a TCP client
+
+	mutex                       sync.Mutex
+	idleTimeout                 time.Duration
+	readDeadline, writeDeadline time.Time
+	closed                      bool
+
+	waiting bool // the client hasn't started the next request yet, guarded by the tracker mutex
+}
+
+func (conn *timeoutConn) deadline(explicit time.Time) time.Time {
+	if explicit.IsZero() && conn.idleTimeout > 0 {
+		return time.Now().Add(conn.idleTimeout)
+	}
+	return explicit
+}
+
+func (conn *timeoutConn) Read(b []byte) (int, error) {
+	conn.mutex.Lock()
+	conn.Conn.SetReadDeadline(conn.deadline(conn.readDeadline))
+	conn.mutex.Unlock()
+	return conn.Conn.Read(b)
+}
+
+func (conn *timeoutConn) Write(b []byte) (int, error) {
+	conn.mutex.Lock()
+	conn.Conn.SetWriteDeadline(conn.deadline(conn.writeDeadline))
+	conn.mutex.Unlock()
+	return conn.Conn.Write(b)
+}
+
+func (conn *timeoutConn) SetDeadline(t time.Time) error {
+	err := conn.SetReadDeadline(t)
+	if err != nil {
+		return err
+	}
+	return conn.SetWriteDeadline(t)
+}
+
+func (conn *timeoutConn) SetReadDeadline(t time.Time) error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	conn.readDeadline = t
+	return conn.Conn.SetReadDeadline(conn.deadline(t))
+}
+
+func (conn *timeoutConn) SetWriteDeadline(t time.Time) error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	conn.writeDeadline = t
+	return conn.Conn.SetWriteDeadline(conn.deadline(t))
+}
+
+func (conn *timeoutConn) setIdleTimeout(timeout time.Duration) {
+	conn.mutex.Lock()
+	conn.idleTimeout = timeout
+	conn.mutex.Unlock()
+}
+
+func (conn *timeoutConn) CloseRead() error {
+	if c, ok := conn.Conn.(interface {
+		CloseRead() error
+	}); ok {
+		return c.CloseRead()
+	}
+	return nil
+}
+
+func (conn *timeoutConn) CloseWrite() error {
+	if c, ok := conn.Conn.(interface {
+		CloseWrite() error
+	}); ok {
+		return c.CloseWrite()
+	}
+	return nil
+}
+
+func (conn *timeoutConn) Close() error {
+	conn.mutex.Lock()
+	closed := conn.closed
+	conn.closed = true
+	conn.mutex.Unlock()
+	if !closed && conn.tracker != nil {
+		conn.tracker.remove(conn)
+	}
+	return conn.Conn.Close()
+}
+
+// trackedConn finds the connection made by the proxy under TLS and read buffers
+func trackedConn(conn net.Conn) *timeoutConn {
+	for {
+		switch c := conn.(type) {
+		case *timeoutConn:
+			return c
+		case *protocol.Conn:
+			conn = c.Conn
+		case *tls.Conn:
+			conn = c.NetConn()
+		default:
+			return nil
+		}
+	}
+}
+
+// setIdleTimeout changes the idle timeout of a connection made by the proxy
+func setIdleTimeout(conn net.Conn, timeout time.Duration) {
+	if tracked := trackedConn(conn); tracked != nil {
+		tracked.setIdleTimeout(timeout)
+	}
+}
+
+// connectContext limits the time to connect to a server, from the lookup of its name to the last address tried
+func connectContext() (context.Context, context.CancelFunc) {
+	if timeout := currentSettings().UpstreamConnectTimeout; timeout > 0 {
+		return context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
+	}
+	return context.WithCancel(context.Background())
+}
+
+// dialServer connects to an origin server or a parent proxy
+func dialServer(ctx context.Context, addr string) (net.Conn, error) {
+	settings := currentSettings()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &timeoutConn{Conn: conn, idleTimeout: time.Duration(settings.BodyIdleTimeout) * time.Second}, nil
+}
+
+// ConnTracker keeps the listeners and the client connections, so the number of connections
+// can be limited and the proxy can shut down without breaking requests in progress.
+type ConnTracker struct {
+	mutex        sync.Mutex
+	listeners    []net.Listener
+	conns        map[*timeoutConn]bool
+	perClient    map[string]int
+	shuttingDown bool
+	drained      chan struct{} // closed when the last connection is closed after the shutdown has begun
+}
+
+var connections = &ConnTracker{
+	conns:     make(map[*timeoutConn]bool),
+	perClient: make(map[string]int),
+	drained:   make(chan struct{}),
+}
+
+func (tracker *ConnTracker) add(conn net.Conn, settings *Settings) (*timeoutConn, error) {
+	client := ""
+	if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		client = tcpAddr.IP.String()
+	}
+
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	switch {
+	case tracker.shuttingDown:
+		return nil, errors.New("the proxy is shutting down")
+	case settings.MaxConnections > 0 && len(tracker.conns) >= settings.MaxConnections:
+		return nil, errors.New("too many connections")
+	case client != "" && settings.MaxConnectionsPerClient > 0 && tracker.perClient[client] >= settings.MaxConnectionsPerClient:
+		return nil, fmt.Errorf("too many connections from %s", client)
+	}
+	tracked := &timeoutConn{
+		Conn:        conn,
+		tracker:     tracker,
+		client:      client,
+		idleTimeout: time.Duration(settings.BodyIdleTimeout) * time.Second,
+	}
+	tracker.conns[tracked] = true
+	if client != "" {
+		tracker.perClient[client]++
+	}
+	return tracked, nil
+}
+
+func (tracker *ConnTracker) remove(conn *timeoutConn) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	delete(tracker.conns, conn)
+	if conn.client != "" {
+		tracker.perClient[conn.client]--
+		if tracker.perClient[conn.client] <= 0 {
+			delete(tracker.perClient, conn.client)
+		}
+	}
+	if tracker.shuttingDown && len(tracker.conns) == 0 {
+		close(tracker.drained)
+	}
+}
+
+// setWaiting marks a connection that waits for the next request, so it can be closed on shutdown.
+// It returns false if the proxy is already shutting down.
+func (tracker *ConnTracker) setWaiting(conn *timeoutConn, waiting bool) bool {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	conn.waiting = waiting
+	return !tracker.shuttingDown
+}
+
+func (tracker *ConnTracker) Closing() bool {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	return tracker.shuttingDown
+}
+
+func (tracker *ConnTracker) listen(network, addr string) net.Listener {
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		log.Fatal("listen failed:", err.Error())
+	}
+	tracker.mutex.Lock()
+	tracker.listeners = append(tracker.listeners, ln)
+	tracker.mutex.Unlock()
+	return ln
+}
+
+// serve accepts connections until the listener is closed
+func (tracker *ConnTracker) serve(ln net.Listener, handle func(net.Conn)) {
+	for {
+		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Println("accept failed:", err.Error())
+			time.Sleep(acceptRetryDelay)
+			continue
+		}
+		tracked, err := tracker.add(conn, currentSettings())
+		if err != nil {
+			log.Printf("connection from %s is refused: %s\n", conn.RemoteAddr(), err)
+			conn.Close()
+			continue
+		}
+		go handle(tracked)
+	}
+}
+
+// Shutdown stops accepting connections, closes the ones waiting for requests and waits until
+// the others are closed. It returns false if some connections are still open after the timeout.
+func (tracker *ConnTracker) Shutdown(timeout time.Duration) bool {
+	tracker.mutex.Lock()
+	tracker.shuttingDown = true
+	for _, ln := range tracker.listeners {
+		ln.Close()
+	}
+	for conn := range tracker.conns {
+		if conn.waiting {
+			conn.Conn.Close()
+		}
+	}
+	if len(tracker.conns) == 0 {
+		close(tracker.drained)
+	}
+	log.Printf("shutting down, %d connections are open\n", len(tracker.conns))
+	tracker.mutex.Unlock()
+
+	select {
+	case <-tracker.drained:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
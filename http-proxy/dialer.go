@@ -0,0 +1,109 @@
+package main
+
+import (
+	"./protocol"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// Origin servers in these networks are reachable only through AllowDestinations,
+// so clients can't use the proxy to get into the local network or the cloud metadata service
+var defaultDeniedDestinations = []string{
+	"0.0.0.0/8",       // this network
+	"10.0.0.0/8",      // private
+	"100.64.0.0/10",   // carrier-grade NAT
+	"127.0.0.0/8",     // loopback
+	"169.254.0.0/16",  // link-local, including the metadata service at 169.254.169.254
+	"172.16.0.0/12",   // private
+	"192.0.0.0/24",    // IETF protocol assignments
+	"192.0.2.0/24",    // documentation
+	"192.168.0.0/16",  // private
+	"198.18.0.0/15",   // benchmarking
+	"198.51.100.0/24", // documentation
+	"203.0.113.0/24",  // documentation
+	"224.0.0.0/4",     // multicast
+	"240.0.0.0/4",     // reserved and broadcast
+	"::/128",          // unspecified
+	"::1/128",         // loopback
+	"64:ff9b::/96",    // NAT64, which maps the IPv4 networks above too
+	"100::/64",        // discard
+	"2001:db8::/32",   // documentation
+	"fc00::/7",        // unique local
+	"fe80::/10",       // link-local
+	"fec0::/10",       // site-local
+	"ff00::/8",        // multicast
+}
+
+var errDestinationDenied = errors.New("destination isn't allowed")
+
+// resolver finds the addresses of origin servers
+var resolver = net.DefaultResolver
+
+// DestinationPolicy vets the addresses of origin servers. Allowed networks override denied ones.
+type DestinationPolicy struct {
+	Denied, Allowed []*net.IPNet
+}
+
+func compileDestinationPolicy(deny, allow []string) (*DestinationPolicy, error) {
+	var policy DestinationPolicy
+	var err error
+	policy.Denied, err = parseNetworks(append(append([]string(nil), defaultDeniedDestinations...), deny...))
+	if err != nil {
+		return nil, err
+	}
+	policy.Allowed, err = parseNetworks(allow)
+	if err != nil {
+		return nil, err
+	}
+	return &policy, nil
+}
+
+// dialErrorStatus chooses the status of the response to a client whose request couldn't be forwarded
+func dialErrorStatus(err error) int {
+	if errors.Is(err, errDestinationDenied) {
+		return protocol.StatusForbidden
+	}
+	if errors.Is(err, errPoolWaitTimeout) {
+		return protocol.StatusGatewayTimeout
+	}
+	return protocol.StatusBadGateway
+}
+
+func (policy *DestinationPolicy) Permits(ip net.IP) bool {
+	return containsIP(policy.Allowed, ip) || !containsIP(policy.Denied, ip)
+}
+
+// Dial resolves the host of addr once and connects to the vetted addresses, so a name
+// that resolves differently the second time can't lead to a denied network.
+// The connection is refused if any of the addresses is denied.
+// UpstreamConnectTimeout applies to the lookup and the connection together.
+func (policy *DestinationPolicy) Dial(addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := connectContext()
+	defer cancel()
+	ipAddrs, err := resolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(ipAddrs) == 0 {
+		return nil, fmt.Errorf("no addresses found for %s", host)
+	}
+	for _, ipAddr := range ipAddrs {
+		if !policy.Permits(ipAddr.IP) {
+			return nil, fmt.Errorf("%w: %s resolves to %s", errDestinationDenied, host, ipAddr.IP)
+		}
+	}
+
+	for _, ipAddr := range ipAddrs {
+		var conn net.Conn
+		conn, err = dialServer(ctx, net.JoinHostPort(ipAddr.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
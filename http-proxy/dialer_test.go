@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDestinationPolicy(t *testing.T) {
+	policy, err := compileDestinationPolicy([]string{"203.0.114.0/24"}, []string{"10.1.0.0/16", "fd00::/64"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		ip      string
+		permits bool
+	}{
+		{"93.184.216.34", true},
+		{"127.0.0.1", false},
+		{"169.254.169.254", false},
+		{"10.0.0.1", false},
+		{"10.1.2.3", true},
+		{"203.0.114.5", false},
+		{"::1", false},
+		{"::ffff:127.0.0.1", false},
+		{"64:ff9b::a00:1", false},
+		{"fe80::1", false},
+		{"fd00::1", true},
+		{"fd01::1", false},
+		{"2606:2800:220:1::1", true},
+	}
+	for _, test := range tests {
+		if permits := policy.Permits(net.ParseIP(test.ip)); permits != test.permits {
+			t.Errorf("Permits(%s) = %v, want %v", test.ip, permits, test.permits)
+		}
+	}
+
+	if _, err := compileDestinationPolicy([]string{"10.0.0.0/33"}, nil); err == nil {
+		t.Error("an invalid network is accepted")
+	}
+}
+
+func TestDialDeniedDestination(t *testing.T) {
+	storeSettings(&Settings{UpstreamConnectTimeout: 1})
+	policy, err := compileDestinationPolicy(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	for _, addr := range []string{listener.Addr().String(), "localhost:80"} {
+		if _, err := policy.Dial(addr); !errors.Is(err, errDestinationDenied) {
+			t.Errorf("Dial(%s): got error %v, want %v", addr, err, errDestinationDenied)
+		}
+	}
+
+	policy, err = compileDestinationPolicy(nil, []string{"127.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := policy.Dial(listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func TestDialLookupTimeout(t *testing.T) {
+	storeSettings(&Settings{UpstreamConnectTimeout: 1})
+	// The DNS server receives the queries and never answers
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	savedResolver := resolver
+	resolver = &net.Resolver{PreferGo: true, Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+		var dialer net.Dialer
+		return dialer.DialContext(ctx, "udp", server.LocalAddr().String())
+	}}
+	defer func() { resolver = savedResolver }()
+
+	policy, err := compileDestinationPolicy(nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, err := policy.Dial("unresolved.example:80"); err == nil {
+		t.Fatal("the name is resolved")
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("the lookup took %s with a timeout of 1s", elapsed)
+	}
+}
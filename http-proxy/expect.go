@@ -0,0 +1,95 @@
+package main
+
+import (
+	"./protocol"
+	"log"
+	"time"
+)
+
+// How long to wait for an origin to accept the body of a request with "Expect: 100-continue"
+// if ContinueTimeout isn't set. Origins that don't support the expectation never answer,
+// so the body is sent anyway after it.
+const defaultContinueTimeout = time.Second
+
+// forwardRequest sends a request to an origin and returns its final response, relaying
+// the interim ones to the client. If the origin answers a request that expects 100 (Continue)
+// with a final response right away, the body isn't sent, and bodySent is false.
+func forwardRequest(clientConn, serverConn *protocol.Conn, request *protocol.Request,
+	responseTimeout, continueTimeout time.Duration) (response *protocol.Response, bodySent bool, err error) {
+	if request.Body == nil || !request.ExpectsContinue() {
+		err = request.WriteTo(serverConn)
+		if err != nil {
+			return nil, false, err
+		}
+		response, err = readFinalResponse(clientConn, serverConn, request, responseTimeout)
+		return response, true, err
+	}
+
+	err = request.WriteHeadTo(serverConn)
+	if err != nil {
+		return nil, false, err
+	}
+	if continueTimeout == 0 {
+		continueTimeout = defaultContinueTimeout
+	}
+	// Peek doesn't consume a partially received status line if the time is out
+	serverConn.SetReadDeadline(time.Now().Add(continueTimeout))
+	_, err = serverConn.Reader.Peek(1)
+	serverConn.SetReadDeadline(time.Time{})
+	if err != nil && !isTimeout(err) {
+		return nil, false, err
+	}
+	if err == nil {
+		response = new(protocol.Response)
+		err = response.ReadFrom(serverConn, request.Method)
+		if err != nil {
+			return nil, false, err
+		}
+		if !response.Interim() {
+			return response, false, nil
+		}
+		err = relayInterimResponse(clientConn, request, response)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	err = request.WriteBodyTo(serverConn)
+	if err != nil {
+		return nil, false, err
+	}
+	response, err = readFinalResponse(clientConn, serverConn, request, responseTimeout)
+	return response, true, err
+}
+
+// readFinalResponse reads responses to a request until the final one, relaying the interim ones.
+// The timeout limits the time until the headers of the final response are received.
+func readFinalResponse(clientConn, serverConn *protocol.Conn, request *protocol.Request,
+	timeout time.Duration) (*protocol.Response, error) {
+	if timeout > 0 {
+		serverConn.SetReadDeadline(time.Now().Add(timeout))
+		defer serverConn.SetReadDeadline(time.Time{})
+	}
+	for {
+		response := new(protocol.Response)
+		err := response.ReadFrom(serverConn, request.Method)
+		if err != nil || !response.Interim() {
+			return response, err
+		}
+		err = relayInterimResponse(clientConn, request, response)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// relayInterimResponse sends an interim response, such as 100 (Continue) or 103 (Early Hints),
+// to the client. HTTP/1.0 clients don't expect them (RFC 7231, section 6.2).
+func relayInterimResponse(clientConn *protocol.Conn, request *protocol.Request, response *protocol.Response) error {
+	if request.Protocol == "HTTP/1.0" {
+		log.Printf("interim response %d isn't relayed to an HTTP/1.0 client\n", response.Code)
+		return nil
+	}
+	response.Protocol = "HTTP/1.1"
+	return response.WriteTo(clientConn)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"./protocol"
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// connPair makes a TCP connection on the loopback interface and returns both of its ends
+func connPair(t *testing.T) (net.Conn, net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+const continueRequest = "POST http://example.com/upload HTTP/1.1\r\nHost: example.com\r\n" +
+	"Expect: 100-continue\r\nContent-Length: 4\r\n\r\nbody"
+
+// forwardToOrigin forwards continueRequest to an origin that answers the request head with reply
+// and the body with a final response. It returns what the origin and the client have received.
+func forwardToOrigin(t *testing.T, reply string, continueTimeout time.Duration) (bodySent bool,
+	received, relayed string, elapsed time.Duration) {
+	proxySide, originSide := connPair(t)
+	clientSide, clientConn := connPair(t)
+	request := readRequest(t, continueRequest)
+
+	originDone := make(chan string, 1)
+	go func() {
+		reader := bufio.NewReader(originSide)
+		var head strings.Builder
+		for {
+			line, err := reader.ReadString('\n')
+			head.WriteString(line)
+			if err != nil || line == "\r\n" {
+				break
+			}
+		}
+		originSide.Write([]byte(reply))
+		if strings.HasPrefix(reply, "HTTP/1.1 100") || reply == "" {
+			body := make([]byte, 4)
+			io.ReadFull(reader, body)
+			head.Write(body)
+			originSide.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n"))
+		}
+		originDone <- head.String()
+	}()
+
+	start := time.Now()
+	response, bodySent, err := forwardRequest(protocol.NewConn(clientConn), protocol.NewConn(proxySide),
+		request, 5*time.Second, continueTimeout)
+	elapsed = time.Since(start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.DiscardBody()
+	received = <-originDone
+
+	clientConn.Close()
+	data, _ := ioutil.ReadAll(clientSide)
+	return bodySent, received, string(data), elapsed
+}
+
+func TestForwardRequestWithoutContinue(t *testing.T) {
+	bodySent, received, relayed, elapsed := forwardToOrigin(t, "", 200*time.Millisecond)
+	if !bodySent || !strings.HasSuffix(received, "\r\n\r\nbody") {
+		t.Errorf("the body isn't sent after the timeout: %q", received)
+	}
+	if elapsed < 200*time.Millisecond || elapsed > 900*time.Millisecond {
+		t.Errorf("the body is sent after %s with a timeout of 200ms", elapsed)
+	}
+	if relayed != "" {
+		t.Errorf("got %q relayed to the client", relayed)
+	}
+}
+
+func TestForwardRequestWithContinue(t *testing.T) {
+	bodySent, received, relayed, _ := forwardToOrigin(t, "HTTP/1.1 100 Continue\r\n\r\n", 5*time.Second)
+	if !bodySent || !strings.HasSuffix(received, "\r\n\r\nbody") {
+		t.Errorf("the body isn't sent after 100 (Continue): %q", received)
+	}
+	if !strings.HasPrefix(relayed, "HTTP/1.1 100 Continue\r\n") {
+		t.Errorf("100 (Continue) isn't relayed: %q", relayed)
+	}
+}
+
+func TestForwardRequestRejectedBeforeBody(t *testing.T) {
+	bodySent, received, _, _ := forwardToOrigin(t,
+		"HTTP/1.1 417 Expectation Failed\r\nContent-Length: 0\r\n\r\n", 5*time.Second)
+	if bodySent || strings.HasSuffix(received, "body") {
+		t.Errorf("the body is sent after a final response: %q", received)
+	}
+}
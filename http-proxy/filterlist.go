@@ -0,0 +1,638 @@
+package main
+
+import (
+	"./protocol"
+	"bufio"
+	"fmt"
+	"github.com/andybalholm/cascadia"
+	"golang.org/x/net/html"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// Resource types of network rules in Adblock Plus filter lists
+type resourceType uint
+
+const (
+	typeOther resourceType = 1 << iota
+	typeScript
+	typeImage
+	typeStylesheet
+	typeObject
+	typeXMLHTTPRequest
+	typeSubdocument
+	typeDocument
+	typeFont
+	typeMedia
+	typePing
+	typeWebSocket
+
+	typeAny = 1<<iota - 1
+)
+
+var resourceTypeNames = map[string]resourceType{
+	"other":          typeOther,
+	"script":         typeScript,
+	"image":          typeImage,
+	"stylesheet":     typeStylesheet,
+	"object":         typeObject,
+	"xmlhttprequest": typeXMLHTTPRequest,
+	"subdocument":    typeSubdocument,
+	"document":       typeDocument,
+	"font":           typeFont,
+	"media":          typeMedia,
+	"ping":           typePing,
+	"websocket":      typeWebSocket,
+}
+
+// Options of exception rules that disable element hiding on matching pages
+const (
+	disableHiding = 1 << iota
+	disableGenericHiding
+)
+
+type networkRule struct {
+	Text string
+
+	token            string
+	pattern          *regexp.Regexp
+	types            resourceType
+	thirdParty       int // 1 for $third-party, -1 for $~third-party
+	domains          []string
+	excludedDomains  []string
+	disabledFeatures int
+}
+
+type ruleIndex struct {
+	byToken     map[string][]*networkRule
+	untokenized []*networkRule
+}
+
+type hidingRule struct {
+	selector        string
+	matcher         cascadia.Selector
+	lookahead       bool
+	excludedDomains []string
+}
+
+// FilterList keeps the rules loaded from Adblock Plus (EasyList) filter files
+type FilterList struct {
+	blocking, exceptions ruleIndex
+
+	genericHiding    []*hidingRule
+	genericLookahead bool // some of the generic rules can't be evaluated on a stream
+	domainHiding     map[string][]*hidingRule
+	// Generic rules with a single class or ID selector are looked up
+	// by the attributes of an element instead of being evaluated one by one
+	genericClasses, genericIDs map[string]bool
+
+	genericExceptions map[string]bool
+	domainExceptions  map[string]map[string]bool
+
+	NetworkRules, HidingRules, Skipped int
+}
+
+func NewFilterList() *FilterList {
+	return &FilterList{
+		blocking:          ruleIndex{byToken: make(map[string][]*networkRule)},
+		exceptions:        ruleIndex{byToken: make(map[string][]*networkRule)},
+		domainHiding:      make(map[string][]*hidingRule),
+		genericClasses:    make(map[string]bool),
+		genericIDs:        make(map[string]bool),
+		genericExceptions: make(map[string]bool),
+		domainExceptions:  make(map[string]map[string]bool),
+	}
+}
+
+func (list *FilterList) LoadFile(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '!' || line[0] == '[' {
+			continue
+		}
+		if !list.addRule(line) {
+			list.Skipped++
+		}
+	}
+	return scanner.Err()
+}
+
+// addRule parses a filter and tells whether it's supported
+func (list *FilterList) addRule(line string) bool {
+	if index := strings.Index(line, "#@#"); index != -1 {
+		return list.addHidingException(line[:index], line[index+3:])
+	}
+	if index := strings.Index(line, "##"); index != -1 {
+		return list.addHidingRule(line[:index], line[index+2:])
+	}
+	if strings.Contains(line, "#?#") || strings.Contains(line, "#$#") {
+		// Extended CSS and snippets need a script running in the browser
+		return false
+	}
+	exception := strings.HasPrefix(line, "@@")
+	rule, ok := parseNetworkRule(strings.TrimPrefix(line, "@@"), exception)
+	if !ok {
+		return false
+	}
+	rule.Text = line
+	if exception {
+		list.exceptions.add(rule)
+	} else {
+		list.blocking.add(rule)
+	}
+	list.NetworkRules++
+	return true
+}
+
+func parseDomains(value, separator string) (domains, excluded []string) {
+	for _, item := range strings.Split(value, separator) {
+		item = strings.ToLower(strings.TrimSpace(item))
+		if strings.HasPrefix(item, "~") {
+			excluded = append(excluded, item[1:])
+		} else if item != "" {
+			domains = append(domains, item)
+		}
+	}
+	return domains, excluded
+}
+
+var simpleSelectorRegexp = regexp.MustCompile(`^[.#][\w-]+$`)
+
+func (list *FilterList) addHidingRule(domainList, selector string) bool {
+	matcher, err := cascadia.Compile(selector)
+	if err != nil {
+		return false
+	}
+	domains, excluded := parseDomains(domainList, ",")
+	rule := &hidingRule{selector, matcher, needsLookahead(selector), excluded}
+	list.HidingRules++
+
+	if domains == nil {
+		if excluded == nil && simpleSelectorRegexp.MatchString(selector) {
+			if selector[0] == '.' {
+				list.genericClasses[selector[1:]] = true
+			} else {
+				list.genericIDs[selector[1:]] = true
+			}
+			return true
+		}
+		list.genericHiding = append(list.genericHiding, rule)
+		list.genericLookahead = list.genericLookahead || rule.lookahead
+		return true
+	}
+	for _, domain := range domains {
+		list.domainHiding[domain] = append(list.domainHiding[domain], rule)
+	}
+	return true
+}
+
+func (list *FilterList) addHidingException(domainList, selector string) bool {
+	domains, _ := parseDomains(domainList, ",")
+	if domains == nil {
+		list.genericExceptions[selector] = true
+		return true
+	}
+	for _, domain := range domains {
+		if list.domainExceptions[domain] == nil {
+			list.domainExceptions[domain] = make(map[string]bool)
+		}
+		list.domainExceptions[domain][selector] = true
+	}
+	return true
+}
+
+// patternToRegexp translates the wildcards and anchors of a network rule pattern
+func patternToRegexp(pattern string, matchCase bool) (*regexp.Regexp, error) {
+	if len(pattern) > 1 && pattern[0] == '/' && pattern[len(pattern)-1] == '/' {
+		expr := pattern[1 : len(pattern)-1]
+		if !matchCase {
+			expr = "(?i)" + expr
+		}
+		return regexp.Compile(expr)
+	}
+
+	var expr strings.Builder
+	if !matchCase {
+		expr.WriteString("(?i)")
+	}
+	switch {
+	case strings.HasPrefix(pattern, "||"):
+		expr.WriteString(`^[a-z][a-z0-9+.-]*://(?:[^/?#]*\.)?`)
+		pattern = pattern[2:]
+	case strings.HasPrefix(pattern, "|"):
+		expr.WriteString("^")
+		pattern = pattern[1:]
+	}
+	anchoredEnd := strings.HasSuffix(pattern, "|")
+	if anchoredEnd {
+		pattern = pattern[:len(pattern)-1]
+	}
+	for _, char := range pattern {
+		switch char {
+		case '*':
+			expr.WriteString(".*")
+		case '^':
+			expr.WriteString(`(?:[^\w\-.%]|$)`)
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(char)))
+		}
+	}
+	if anchoredEnd {
+		expr.WriteString("$")
+	}
+	return regexp.Compile(expr.String())
+}
+
+func parseNetworkRule(line string, exception bool) (*networkRule, bool) {
+	rule := &networkRule{types: typeAny}
+	pattern := line
+	matchCase := false
+
+	if index := strings.LastIndex(line, "$"); index != -1 && !strings.HasSuffix(line, "/") {
+		pattern = line[:index]
+		var includedTypes, excludedTypes resourceType
+		for _, option := range strings.Split(line[index+1:], ",") {
+			option = strings.ToLower(strings.TrimSpace(option))
+			negated := strings.HasPrefix(option, "~")
+			name := strings.TrimPrefix(option, "~")
+
+			if t, ok := resourceTypeNames[name]; ok {
+				if negated {
+					excludedTypes |= t
+				} else {
+					includedTypes |= t
+				}
+				continue
+			}
+			switch {
+			case name == "third-party":
+				rule.thirdParty = 1
+				if negated {
+					rule.thirdParty = -1
+				}
+			case name == "match-case":
+				matchCase = true
+			case strings.HasPrefix(option, "domain="):
+				rule.domains, rule.excludedDomains = parseDomains(option[len("domain="):], "|")
+			case name == "elemhide" && exception:
+				rule.disabledFeatures |= disableHiding
+			case name == "generichide" && exception:
+				rule.disabledFeatures |= disableGenericHiding
+			case name == "collapse", name == "important":
+			default:
+				// Options like $popup or $csp can't be applied by a proxy
+				return nil, false
+			}
+		}
+		if exception && includedTypes&typeDocument != 0 {
+			// The whole page is allowed, including its elements
+			rule.disabledFeatures |= disableHiding
+		}
+		if includedTypes != 0 {
+			rule.types = includedTypes
+		} else if rule.disabledFeatures != 0 {
+			// $elemhide and $generichide don't allow any requests
+			rule.types = 0
+		}
+		rule.types &^= excludedTypes
+	}
+	if pattern == "" || pattern == "*" {
+		if rule.domains == nil {
+			return nil, false
+		}
+		pattern = "*"
+	}
+
+	var err error
+	rule.pattern, err = patternToRegexp(pattern, matchCase)
+	if err != nil {
+		return nil, false
+	}
+	rule.token = ruleToken(pattern)
+	return rule, rule.types != 0 || rule.disabledFeatures != 0
+}
+
+var tokenRegexp = regexp.MustCompile(`[a-z0-9%]+`)
+
+// ruleToken picks the longest token of the pattern that must appear in a matching URL as a whole
+func ruleToken(pattern string) string {
+	if len(pattern) > 1 && pattern[0] == '/' && pattern[len(pattern)-1] == '/' {
+		return ""
+	}
+	pattern = strings.ToLower(pattern)
+	anchoredStart := strings.HasPrefix(pattern, "|")
+	anchoredEnd := strings.HasSuffix(pattern, "|")
+	pattern = strings.Trim(pattern, "|")
+
+	best := ""
+	for _, bounds := range tokenRegexp.FindAllStringIndex(pattern, -1) {
+		start, end := bounds[0], bounds[1]
+		if start == 0 && !anchoredStart || end == len(pattern) && !anchoredEnd {
+			continue
+		}
+		if start > 0 && pattern[start-1] == '*' || end < len(pattern) && pattern[end] == '*' {
+			continue
+		}
+		if end-start > len(best) {
+			best = pattern[start:end]
+		}
+	}
+	return best
+}
+
+func (index *ruleIndex) add(rule *networkRule) {
+	if rule.token == "" {
+		index.untokenized = append(index.untokenized, rule)
+	} else {
+		index.byToken[rule.token] = append(index.byToken[rule.token], rule)
+	}
+}
+
+type requestInfo struct {
+	url, host, documentHost string
+	thirdParty              bool
+	types                   resourceType
+}
+
+func hostMatches(host, domain string) bool {
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+func anyHostMatches(host string, domains []string) bool {
+	for _, domain := range domains {
+		if hostMatches(host, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+func (rule *networkRule) matches(info *requestInfo) bool {
+	if rule.thirdParty == 1 && !info.thirdParty || rule.thirdParty == -1 && info.thirdParty {
+		return false
+	}
+	if rule.domains != nil && !anyHostMatches(info.documentHost, rule.domains) ||
+		anyHostMatches(info.documentHost, rule.excludedDomains) {
+		return false
+	}
+	return rule.pattern.MatchString(info.url)
+}
+
+// find returns the first rule that matches the request and is accepted by the callback
+func (index *ruleIndex) find(info *requestInfo, accept func(*networkRule) bool) *networkRule {
+	seen := make(map[string]bool)
+	for _, token := range tokenRegexp.FindAllString(strings.ToLower(info.url), -1) {
+		if seen[token] {
+			continue
+		}
+		seen[token] = true
+		for _, rule := range index.byToken[token] {
+			if rule.matches(info) && accept(rule) {
+				return rule
+			}
+		}
+	}
+	for _, rule := range index.untokenized {
+		if rule.matches(info) && accept(rule) {
+			return rule
+		}
+	}
+	return nil
+}
+
+// baseDomain approximates the registrable domain of a host by its last two labels
+func baseDomain(host string) string {
+	if net.ParseIP(host) != nil {
+		return host
+	}
+	labels := strings.Split(strings.TrimSuffix(host, "."), ".")
+	if len(labels) <= 2 {
+		return host
+	}
+	return strings.Join(labels[len(labels)-2:], ".")
+}
+
+var destinationTypes = map[string]resourceType{
+	"script":   typeScript,
+	"image":    typeImage,
+	"style":    typeStylesheet,
+	"object":   typeObject,
+	"embed":    typeObject,
+	"iframe":   typeSubdocument,
+	"frame":    typeSubdocument,
+	"document": typeDocument,
+	"font":     typeFont,
+	"audio":    typeMedia,
+	"video":    typeMedia,
+	"track":    typeMedia,
+}
+
+var extensionTypes = map[string]resourceType{
+	".js":    typeScript,
+	".css":   typeStylesheet,
+	".png":   typeImage,
+	".gif":   typeImage,
+	".jpg":   typeImage,
+	".jpeg":  typeImage,
+	".webp":  typeImage,
+	".svg":   typeImage,
+	".ico":   typeImage,
+	".woff":  typeFont,
+	".woff2": typeFont,
+	".ttf":   typeFont,
+	".mp4":   typeMedia,
+	".webm":  typeMedia,
+	".mp3":   typeMedia,
+	".swf":   typeObject,
+}
+
+// guessResourceType finds out what a request is for, since a proxy doesn't see the element that caused it
+func guessResourceType(request *protocol.Request, requestURL *url.URL) resourceType {
+	if value, ok := request.Header("Sec-Fetch-Dest"); ok {
+		if t, ok := destinationTypes[strings.ToLower(value)]; ok {
+			return t
+		}
+		if value == "empty" {
+			return typeXMLHTTPRequest
+		}
+	}
+	if value, ok := request.Header("Upgrade"); ok && strings.EqualFold(value, "websocket") {
+		return typeWebSocket
+	}
+	if value, ok := request.Header("X-Requested-With"); ok && strings.EqualFold(value, "XMLHttpRequest") {
+		return typeXMLHTTPRequest
+	}
+	if t, ok := extensionTypes[strings.ToLower(path.Ext(requestURL.Path))]; ok {
+		return t
+	}
+	if value, ok := request.Header("Accept"); ok {
+		switch {
+		case strings.HasPrefix(value, "text/html"):
+			if _, ok := request.Header("Referer"); ok {
+				return typeSubdocument
+			}
+			return typeDocument
+		case strings.HasPrefix(value, "text/css"):
+			return typeStylesheet
+		case strings.HasPrefix(value, "image/"):
+			return typeImage
+		}
+	}
+	return typeOther
+}
+
+func newRequestInfo(rawURL string, request *protocol.Request) (*requestInfo, error) {
+	requestURL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	info := &requestInfo{
+		url:          rawURL,
+		host:         strings.ToLower(requestURL.Hostname()),
+		documentHost: strings.ToLower(requestURL.Hostname()),
+		types:        guessResourceType(request, requestURL),
+	}
+	if referer, ok := request.Header("Referer"); ok {
+		if refererURL, err := url.Parse(referer); err == nil && refererURL.Host != "" {
+			info.documentHost = strings.ToLower(refererURL.Hostname())
+		}
+	}
+	info.thirdParty = baseDomain(info.host) != baseDomain(info.documentHost)
+	return info, nil
+}
+
+// BlockingRule returns a network rule that blocks the request, or nil if the request is allowed
+func (list *FilterList) BlockingRule(rawURL string, request *protocol.Request) *networkRule {
+	info, err := newRequestInfo(rawURL, request)
+	if err != nil {
+		return nil
+	}
+	accept := func(rule *networkRule) bool { return rule.types&info.types != 0 }
+	rule := list.blocking.find(info, accept)
+	if rule == nil || list.exceptions.find(info, accept) != nil {
+		return nil
+	}
+	return rule
+}
+
+// HidingRule compiles the element hiding rules applicable to a page into a URLRule.
+// The second result is false if there are no such rules.
+func (list *FilterList) HidingRule(rawURL string) (URLRule, bool) {
+	pageURL, err := url.Parse(rawURL)
+	if err != nil {
+		return URLRule{}, false
+	}
+	host := strings.ToLower(pageURL.Hostname())
+	info := &requestInfo{url: rawURL, host: host, documentHost: host, types: typeDocument}
+
+	var disabled int
+	list.exceptions.find(info, func(rule *networkRule) bool {
+		disabled |= rule.disabledFeatures
+		return false
+	})
+	if disabled&disableHiding != 0 {
+		return URLRule{}, false
+	}
+
+	// Exceptions are looked up in the sets of the page domains, so nothing is copied
+	exceptionSets := []map[string]bool{list.genericExceptions}
+	var domainRules []*hidingRule
+	for domain := host; domain != ""; {
+		if exceptions, ok := list.domainExceptions[domain]; ok {
+			exceptionSets = append(exceptionSets, exceptions)
+		}
+		domainRules = append(domainRules, list.domainHiding[domain]...)
+
+		index := strings.IndexByte(domain, '.')
+		if index == -1 {
+			break
+		}
+		domain = domain[index+1:]
+	}
+
+	excepted := func(selector string) bool {
+		for _, exceptions := range exceptionSets {
+			if exceptions[selector] {
+				return true
+			}
+		}
+		return false
+	}
+	applies := func(rule *hidingRule) bool {
+		return !excepted(rule.selector) && !anyHostMatches(host, rule.excludedDomains)
+	}
+
+	var rules []*hidingRule
+	rule := URLRule{}
+	for _, candidate := range domainRules {
+		if applies(candidate) {
+			rules = append(rules, candidate)
+			rule.Selectors = append(rule.Selectors, candidate.selector)
+			rule.Lookahead = rule.Lookahead || candidate.lookahead
+		}
+	}
+	// Generic rules are checked when an element matches instead of being collected for every page
+	generic := disabled&disableGenericHiding == 0 &&
+		len(list.genericHiding)+len(list.genericClasses)+len(list.genericIDs) > 0
+	if rules == nil && !generic {
+		return URLRule{}, false
+	}
+	rule.Lookahead = rule.Lookahead || generic && list.genericLookahead
+
+	rule.Matchers = []cascadia.Selector{func(node *html.Node) bool {
+		if node.Type != html.ElementNode {
+			return false
+		}
+		if generic {
+			for _, attr := range node.Attr {
+				switch attr.Key {
+				case "id":
+					if list.genericIDs[attr.Val] && !excepted("#"+attr.Val) {
+						return true
+					}
+				case "class":
+					for _, class := range strings.Fields(attr.Val) {
+						if list.genericClasses[class] && !excepted("."+class) {
+							return true
+						}
+					}
+				}
+			}
+			for _, rule := range list.genericHiding {
+				if rule.matcher.Match(node) && applies(rule) {
+					return true
+				}
+			}
+		}
+		for _, rule := range rules {
+			if rule.matcher.Match(node) {
+				return true
+			}
+		}
+		return false
+	}}
+	return rule, true
+}
+
+func loadFilterLists(filenames []string) (*FilterList, error) {
+	list := NewFilterList()
+	for _, filename := range filenames {
+		err := list.LoadFile(resolveConfigPath(filename))
+		if err != nil {
+			return nil, fmt.Errorf("can't load a filter list: %s", err)
+		}
+	}
+	return list, nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"golang.org/x/net/html"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func newTestFilterList(t *testing.T, rules ...string) *FilterList {
+	list := NewFilterList()
+	for _, rule := range rules {
+		if !list.addRule(rule) {
+			t.Fatalf("rule %q is skipped", rule)
+		}
+	}
+	return list
+}
+
+func TestBlockingRule(t *testing.T) {
+	list := newTestFilterList(t,
+		"||ads.example.com^",
+		"@@||ads.example.com/allowed/",
+		"/banner/*$image",
+		"||tracker.example^$third-party",
+	)
+	tests := []struct {
+		url, request string
+		blocked      bool
+	}{
+		{"http://ads.example.com/a.js", "", true},
+		{"http://sub.ads.example.com/a.js", "", true},
+		{"http://ads.example.com.evil/a.js", "", false},
+		{"http://ads.example.com/allowed/a.js", "", false},
+		{"http://example.com/banner/1.png", "", true},
+		{"http://example.com/banner/1.html", "Accept: text/html\r\n", false},
+		{"http://tracker.example/t.gif", "Referer: http://news.example.org/\r\n", true},
+		{"http://tracker.example/t.gif", "Referer: http://tracker.example/\r\n", false},
+	}
+	for _, test := range tests {
+		request := readRequest(t, "GET "+test.url+" HTTP/1.1\r\n"+test.request+"\r\n")
+		if blocked := list.BlockingRule(test.url, request) != nil; blocked != test.blocked {
+			t.Errorf("%s with %q: got blocked %v, want %v", test.url, test.request, blocked, test.blocked)
+		}
+	}
+}
+
+// hiddenElements returns the IDs of the elements of a page that the rule hides
+func hiddenElements(t *testing.T, rule URLRule, page string) []string {
+	document, err := html.Parse(strings.NewReader(page))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hidden []string
+	var walk func(*html.Node)
+	walk = func(node *html.Node) {
+		for _, matcher := range rule.Matchers {
+			if matcher.Match(node) {
+				for _, attr := range node.Attr {
+					if attr.Key == "id" {
+						hidden = append(hidden, attr.Val)
+					}
+				}
+				break
+			}
+		}
+		for child := node.FirstChild; child != nil; child = child.NextSibling {
+			walk(child)
+		}
+	}
+	walk(document)
+	return hidden
+}
+
+func TestHidingRule(t *testing.T) {
+	list := newTestFilterList(t,
+		"##.ad",
+		"###top-ad",
+		"##div[data-ad]",
+		"~shop.example.com##.sponsored",
+		"example.com##.promo",
+		"news.example.com#@#.ad",
+		"example.com#@#div[data-ad]",
+		"@@||plain.example^$elemhide",
+		"@@||nogeneric.example^$generichide",
+	)
+	page := `<div id="a" class="ad"></div><div id="top-ad"></div><div id="b" data-ad="1"></div>
+		<div id="c" class="x sponsored"></div><div id="d" class="promo"></div><div id="e" class="content"></div>`
+	tests := []struct {
+		url    string
+		hidden []string
+	}{
+		{"http://other.example/", []string{"a", "top-ad", "b", "c"}},
+		{"http://example.com/", []string{"a", "top-ad", "c", "d"}},
+		{"http://news.example.com/", []string{"top-ad", "c", "d"}},
+		{"http://shop.example.com/", []string{"a", "top-ad", "d"}},
+		{"http://nogeneric.example/", nil},
+		{"http://plain.example/", nil},
+	}
+	for _, test := range tests {
+		rule, ok := list.HidingRule(test.url)
+		if !ok {
+			if test.hidden != nil {
+				t.Errorf("%s: no rule", test.url)
+			}
+			continue
+		}
+		if hidden := hiddenElements(t, rule, page); !reflect.DeepEqual(hidden, test.hidden) {
+			t.Errorf("%s: got hidden %q, want %q", test.url, hidden, test.hidden)
+		}
+	}
+
+	rule, _ := list.HidingRule("http://example.com/")
+	if !reflect.DeepEqual(rule.Selectors, []string{".promo"}) {
+		t.Errorf("got selectors %q, want only the rules of the domain", rule.Selectors)
+	}
+	if rule.Lookahead {
+		t.Error("simple selectors need lookahead")
+	}
+}
+
+func TestHidingRulesApplyOnlyToPages(t *testing.T) {
+	settings := &Settings{filterList: newTestFilterList(t, "##.ad"), rulesVersion: "1"}
+	tests := []struct {
+		url, request string
+		page         bool
+	}{
+		{"http://example.com/", "Accept: text/html\r\n", true},
+		{"http://example.com/frame", "Sec-Fetch-Dest: iframe\r\n", true},
+		{"http://example.com/page", "", true},
+		{"http://example.com/logo.png", "", false},
+		{"http://example.com/app.js", "Accept: */*\r\n", false},
+		{"http://example.com/image", "Accept: image/webp\r\n", false},
+		{"http://example.com/api", "Sec-Fetch-Dest: empty\r\n", false},
+	}
+	for _, test := range tests {
+		request := readRequest(t, "GET "+test.url+" HTTP/1.1\r\nAccept-Encoding: gzip, zstd\r\n"+test.request+"\r\n")
+		rules := settings.matchingRules(test.url, request)
+		if page := rules != nil; page != test.page {
+			t.Errorf("%s with %q: got rules %v, want %v", test.url, test.request, page, test.page)
+		}
+		if key := settings.cacheKey(test.url, rules); (key != test.url) != test.page {
+			t.Errorf("%s with %q: got cache key %q", test.url, test.request, key)
+		}
+		ModifyRequest(rules, request)
+		if value, _ := request.Header("Accept-Encoding"); (value != "gzip, zstd") != test.page {
+			t.Errorf("%s with %q: got Accept-Encoding %q", test.url, test.request, value)
+		}
+	}
+}
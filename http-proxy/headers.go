@@ -0,0 +1,136 @@
+package main
+
+import (
+	"./protocol"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Messages that header rules apply to
+const (
+	ApplyToRequest  = "request"
+	ApplyToResponse = "response"
+)
+
+type HeaderRuleConfig struct {
+	Apply               string
+	URL, Method, Status string // regexps, an empty one matches anything
+	CrossOrigin         bool   // match only requests with a Referer from another origin
+	Delete              []string
+	Set, Add            map[string]string
+}
+
+type HeaderRule struct {
+	Apply               string
+	URL, Method, Status *regexp.Regexp
+	CrossOrigin         bool
+	Delete              []string
+	Set, Add            map[string]string
+}
+
+func compileHeaderRule(ruleConfig HeaderRuleConfig) (HeaderRule, error) {
+	rule := HeaderRule{
+		Apply:       ruleConfig.Apply,
+		CrossOrigin: ruleConfig.CrossOrigin,
+		Delete:      ruleConfig.Delete,
+		Set:         ruleConfig.Set,
+		Add:         ruleConfig.Add,
+	}
+	switch rule.Apply {
+	case ApplyToRequest:
+		if ruleConfig.Status != "" {
+			return rule, errors.New("request rules can't depend on a status")
+		}
+	case ApplyToResponse:
+	default:
+		return rule, fmt.Errorf("Apply should be %s or %s", ApplyToRequest, ApplyToResponse)
+	}
+
+	for _, name := range rule.Delete {
+		if !protocol.ValidHeader(name, "") {
+			return rule, fmt.Errorf("invalid header name %q", name)
+		}
+	}
+	// A line break in a value would let the config inject headers into the messages
+	for _, headers := range []map[string]string{rule.Set, rule.Add} {
+		for name, value := range headers {
+			if !protocol.ValidHeader(name, value) {
+				return rule, fmt.Errorf("invalid header %q: %q", name, value)
+			}
+		}
+	}
+
+	var err error
+	for _, item := range []struct {
+		expr   string
+		result **regexp.Regexp
+	}{
+		{ruleConfig.URL, &rule.URL},
+		{ruleConfig.Method, &rule.Method},
+		{ruleConfig.Status, &rule.Status},
+	} {
+		*item.result, err = compileOptionalRegexp(item.expr)
+		if err != nil {
+			return rule, err
+		}
+	}
+	return rule, nil
+}
+
+func origin(rawURL string) string {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(parsed.Scheme + "://" + parsed.Host)
+}
+
+func isCrossOrigin(url string, request *protocol.Request) bool {
+	referer, ok := request.Header("Referer")
+	return ok && origin(referer) != origin(url)
+}
+
+func (rule *HeaderRule) matches(url string, request *protocol.Request, response *protocol.Response) bool {
+	if rule.URL != nil && !rule.URL.MatchString(url) {
+		return false
+	}
+	if rule.Method != nil && !rule.Method.MatchString(request.Method) {
+		return false
+	}
+	if rule.Status != nil && !rule.Status.MatchString(strconv.Itoa(response.Code)) {
+		return false
+	}
+	return !rule.CrossOrigin || isCrossOrigin(url, request)
+}
+
+func (rule *HeaderRule) applyTo(message *protocol.MessageBase) {
+	for _, name := range rule.Delete {
+		message.DeleteHeader(name)
+	}
+	for name, value := range rule.Set {
+		message.SetHeader(name, value)
+	}
+	for name, value := range rule.Add {
+		message.AddHeader(name, value)
+	}
+}
+
+// rewriteHeaders applies the header rules to a request or, if response isn't nil, to its response
+func (settings *Settings) rewriteHeaders(url string, request *protocol.Request, response *protocol.Response) {
+	apply := ApplyToRequest
+	message := &request.MessageBase
+	if response != nil {
+		apply = ApplyToResponse
+		message = &response.MessageBase
+	}
+
+	for _, rule := range settings.headerRules {
+		if rule.Apply == apply && rule.matches(url, request, response) {
+			rule.applyTo(message)
+		}
+	}
+}
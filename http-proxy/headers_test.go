@@ -0,0 +1,67 @@
+package main
+
+import (
+	"./protocol"
+	"testing"
+)
+
+func TestCompileHeaderRule(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  HeaderRuleConfig
+		wantErr bool
+	}{
+		{"valid", HeaderRuleConfig{Apply: ApplyToResponse, Status: "^2", Delete: []string{"Server"},
+			Set: map[string]string{"X-Frame-Options": "DENY"}, Add: map[string]string{"Vary": "Origin"}}, false},
+		{"empty value", HeaderRuleConfig{Apply: ApplyToRequest, Set: map[string]string{"X-A": ""}}, false},
+		{"no Apply", HeaderRuleConfig{Set: map[string]string{"X-A": "a"}}, true},
+		{"status of a request", HeaderRuleConfig{Apply: ApplyToRequest, Status: "200"}, true},
+		{"invalid regexp", HeaderRuleConfig{Apply: ApplyToRequest, URL: "("}, true},
+		{"empty name", HeaderRuleConfig{Apply: ApplyToRequest, Delete: []string{""}}, true},
+		{"colon in a name", HeaderRuleConfig{Apply: ApplyToRequest, Set: map[string]string{"X-A:": "a"}}, true},
+		{"space in a name", HeaderRuleConfig{Apply: ApplyToRequest, Add: map[string]string{"X A": "a"}}, true},
+		{"CRLF in a set value", HeaderRuleConfig{Apply: ApplyToResponse,
+			Set: map[string]string{"X-A": "a\r\nSet-Cookie: session=evil"}}, true},
+		{"LF in an added value", HeaderRuleConfig{Apply: ApplyToRequest, Add: map[string]string{"X-A": "a\nb"}}, true},
+		{"NUL in a value", HeaderRuleConfig{Apply: ApplyToRequest, Set: map[string]string{"X-A": "a\x00"}}, true},
+	}
+	for _, test := range tests {
+		_, err := compileHeaderRule(test.config)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: got error %v, want error %v", test.name, err, test.wantErr)
+		}
+	}
+}
+
+func TestHeaderRuleApply(t *testing.T) {
+	rule, err := compileHeaderRule(HeaderRuleConfig{
+		Apply:       ApplyToRequest,
+		URL:         "^http://example\\.com/",
+		CrossOrigin: true,
+		Delete:      []string{"Cookie"},
+		Set:         map[string]string{"DNT": "1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "http://example.com/a"
+	request := readRequest(t, "GET "+url+" HTTP/1.1\r\nCookie: a=b\r\nReferer: http://other.example/\r\n\r\n")
+	if !rule.matches(url, request, nil) {
+		t.Fatal("the rule doesn't match a cross-origin request")
+	}
+	rule.applyTo(&request.MessageBase)
+	if _, ok := request.Header("Cookie"); ok {
+		t.Error("Cookie isn't deleted")
+	}
+	if value, _ := request.Header("DNT"); value != "1" {
+		t.Errorf("got DNT %q", value)
+	}
+
+	request = readRequest(t, "GET "+url+" HTTP/1.1\r\nReferer: http://EXAMPLE.com/b\r\n\r\n")
+	if rule.matches(url, request, nil) {
+		t.Error("the rule matches a same-origin request")
+	}
+	if rule.matches("http://other.example/", request, &protocol.Response{}) {
+		t.Error("the rule matches another URL")
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/PuerkitoBio/goquery"
+	"github.com/andybalholm/cascadia"
+)
+
+// Positions of injected snippets
+const (
+	PositionHeadEnd   = "head-end"
+	PositionBodyStart = "body-start"
+	PositionBodyEnd   = "body-end"
+	PositionBefore    = "before" // before each element matching the selector
+	PositionAfter     = "after"  // after each element matching the selector
+)
+
+type InjectionConfig struct {
+	Position, Selector string
+	CSS, JS, HTML      string
+}
+
+type Injection struct {
+	Position  string
+	Matcher   cascadia.Selector
+	HTML      string
+	Lookahead bool
+}
+
+func compileInjection(injectionConfig InjectionConfig) (Injection, error) {
+	injection := Injection{Position: injectionConfig.Position}
+
+	snippets := 0
+	for _, item := range []struct{ value, format string }{
+		{injectionConfig.CSS, "<style>%s</style>"},
+		{injectionConfig.JS, "<script>%s</script>"},
+		{injectionConfig.HTML, "%s"},
+	} {
+		if item.value != "" {
+			injection.HTML = fmt.Sprintf(item.format, item.value)
+			snippets++
+		}
+	}
+	if snippets != 1 {
+		return injection, errors.New("exactly one of CSS, JS and HTML should be specified")
+	}
+
+	switch injection.Position {
+	case PositionHeadEnd, PositionBodyStart, PositionBodyEnd:
+		if injectionConfig.Selector != "" {
+			return injection, fmt.Errorf("position %s doesn't need a selector", injection.Position)
+		}
+	case PositionBefore, PositionAfter:
+		var err error
+		injection.Matcher, err = cascadia.Compile(injectionConfig.Selector)
+		if err != nil {
+			return injection, fmt.Errorf("can't compile a CSS selector: %s", err)
+		}
+		injection.Lookahead = needsLookahead(injectionConfig.Selector)
+	default:
+		return injection, fmt.Errorf("unknown position %s", injection.Position)
+	}
+	return injection, nil
+}
+
+func injectIntoDocument(doc *goquery.Document, injections []Injection) {
+	for _, injection := range injections {
+		switch injection.Position {
+		case PositionHeadEnd:
+			doc.Find("head").AppendHtml(injection.HTML)
+		case PositionBodyStart:
+			doc.Find("body").PrependHtml(injection.HTML)
+		case PositionBodyEnd:
+			doc.Find("body").AppendHtml(injection.HTML)
+		case PositionBefore:
+			doc.FindMatcher(injection.Matcher).BeforeHtml(injection.HTML)
+		case PositionAfter:
+			doc.FindMatcher(injection.Matcher).AfterHtml(injection.HTML)
+		}
+	}
+}
@@ -12,10 +12,14 @@ import (
 	"net"
 	"net/url"
 	"os"
+	"os/signal"
 	"path"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -23,19 +27,66 @@ const ServerName = "http-proxy"
 
 type Config struct {
 	ListenOn, AllowTunnelsTo string
+	SocksListenOn            string            // an optional address for SOCKS5 clients
+	SocksUsers               map[string]string // passwords of SOCKS5 users, none means no authentication
+	ListenOnUnix             string            // an optional Unix socket path, its clients aren't checked by the lists below
 	RemoveElements           map[string][]string
+	InjectElements           map[string][]InjectionConfig
+	FilterLists              []string
+	BlockRequests            []BlockRuleConfig
+	RewriteHeaders           []HeaderRuleConfig
+	StripQueryParams         []string
+	RewriteURLs              []URLRewriteConfig
+
+	InterceptTunnels       bool
+	CACertificate, CAKey   string
+	DontInterceptTunnelsTo []string
+
+	KeepAliveTimeout int // seconds
+
+	// Timeouts in seconds, zero disables a timeout
+	HeaderReadTimeout       int // from the first byte of a request to the end of its headers, or of a SOCKS5 handshake
+	BodyIdleTimeout         int // without progress on a connection when no other timeout applies
+	UpstreamConnectTimeout  int // including the TLS handshake
+	UpstreamResponseTimeout int // from sending a request to receiving the headers of the response
+	TunnelIdleTimeout       int // without data in either direction
+	ContinueTimeout         int // for 100 (Continue) before sending the body anyway, zero means one second
+
+	MaxConnections, MaxConnectionsPerClient int // zero means no limit
+	MaxHeaderBytes, MaxHeaderCount          int // of a message, zero means the default
+	ShutdownTimeout                         int // seconds to finish requests in progress on SIGTERM
+
+	PoolMaxIdle, PoolMaxConnsPerHost int
+	PoolIdleTimeout                  int // seconds
+
+	CacheMemorySize, CacheDiskSize int // megabytes, zero disables a tier
+	CacheDir                       string
+
+	AllowClients, DenyClients             []string // networks in CIDR notation or single addresses
+	AllowTunnelClients, DenyTunnelClients []string // the same for tunnels opened with CONNECT and SOCKS5
+
+	AllowUpgradesTo  string   // a regexp matched against host:port of origin servers
+	UpgradeProtocols []string // protocols that clients may switch to with Upgrade, such as websocket
+
+	DenyDestinations  []string // networks of origin servers to refuse in addition to the private and reserved ones
+	AllowDestinations []string // exceptions from the denied networks, such as an intranet server
+
+	CredentialsFile string // an htpasswd file with bcrypt hashes, proxy authentication is disabled without it
+	Users           map[string]UserConfig
+
+	Parents []ParentConfig
+	Routes  []RouteConfig // the first route matching a destination is used, others are reached directly
 }
 
 type URLRule struct {
-	Pattern   *regexp.Regexp
-	Selectors []string
+	Pattern    *regexp.Regexp
+	Selectors  []string
+	Matchers   []cascadia.Selector
+	Injections []Injection
+	Lookahead  bool // some of the selectors can't be evaluated on a stream
 }
 
 var (
-	config                  Config
-	allowedTunnelAddrRegexp *regexp.Regexp
-	urlRules                []URLRule
-
 	executableDir  = filepath.Dir(os.Args[0])
 	configFilename = path.Join(executableDir, "config.json")
 	templateDir    = path.Join(executableDir, "templates")
@@ -51,33 +102,58 @@ func loadData(filename string, v interface{}) error {
 	return json.NewDecoder(f).Decode(v)
 }
 
-func loadTemplate(name string) *template.Template {
+func loadTemplate(name string) (*template.Template, error) {
 	path := path.Join(templateDir, name)
 	result, err := template.New(name).ParseFiles(path)
 	if err != nil {
-		log.Fatalf("failed to load %s: %s\n", path, err)
+		return nil, fmt.Errorf("failed to load %s: %s", path, err)
 	}
-	return result
+	return result, nil
 }
 
-var errorTemplate = loadTemplate("error.tpl")
-
-func transformURL(rawURL string) (string, string, error) {
+func transformURL(rawURL string) (string, string, bool, error) {
 	url, err := url.Parse(rawURL)
 	if err != nil {
-		return "", "", err
+		return "", "", false, err
 	}
 	if url.Opaque != "" || url.User != nil || url.Fragment != "" {
-		return "", "", errors.New(fmt.Sprintf(`URL %s contains prohibited elements`, rawURL))
+		return "", "", false, errors.New(fmt.Sprintf(`URL %s contains prohibited elements`, rawURL))
+	}
+
+	var secure bool
+	port := "80"
+	switch strings.ToLower(url.Scheme) {
+	case "http":
+	case "https":
+		secure = true
+		port = "443"
+	default:
+		return "", "", false, fmt.Errorf("URL %s has unsupported scheme", rawURL)
 	}
 
 	host := url.Host
-	if !strings.ContainsRune(host, ':') {
-		host += ":80"
+	if url.Port() == "" {
+		host = net.JoinHostPort(url.Hostname(), port)
 	}
 	url.Scheme = ""
 	url.Host = ""
-	return host, url.String(), nil
+	return host, url.String(), secure, nil
+}
+
+func interceptedURL(tunnelAddr, requestURI string) (string, error) {
+	if !strings.HasPrefix(requestURI, "/") {
+		return "", fmt.Errorf("request URI %s isn't in origin form", requestURI)
+	}
+	host, port, err := net.SplitHostPort(tunnelAddr)
+	if err != nil {
+		return "", err
+	}
+	if port != "443" {
+		host = net.JoinHostPort(host, port)
+	} else if strings.ContainsRune(host, ':') {
+		host = "[" + host + "]"
+	}
+	return "https://" + host + requestURI, nil
 }
 
 func defaultResponseHeaders() []protocol.Header {
@@ -88,8 +164,50 @@ func defaultResponseHeaders() []protocol.Header {
 	}
 }
 
-func copyAndClose(dst *net.TCPConn, src *net.TCPConn) {
-	written, err := io.Copy(dst, src)
+type halfCloser interface {
+	net.Conn
+	CloseRead() error
+	CloseWrite() error
+}
+
+// tunnelActivity is the time when data was copied in either direction of a tunnel
+type tunnelActivity struct {
+	last int64
+}
+
+func (activity *tunnelActivity) touch() {
+	atomic.StoreInt64(&activity.last, time.Now().UnixNano())
+}
+
+func (activity *tunnelActivity) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&activity.last)))
+}
+
+// copyAndClose copies data from src to dst. One side of a tunnel may be silent
+// while the other one is busy, so src may time out only if the whole tunnel is idle.
+func copyAndClose(dst halfCloser, src halfCloser, timeout time.Duration, activity *tunnelActivity) {
+	buf := make([]byte, 32*1024)
+	var written int64
+	var err error
+	for {
+		var n int
+		n, err = src.Read(buf)
+		if n > 0 {
+			activity.touch()
+			n, err = dst.Write(buf[:n])
+			written += int64(n)
+			if err != nil {
+				break
+			}
+		}
+		if err == io.EOF {
+			err = nil
+			break
+		}
+		if err != nil && !(isTimeout(err) && activity.idle() < timeout) {
+			break
+		}
+	}
 	src.CloseRead()
 	dst.CloseWrite()
 	if err != nil {
@@ -100,7 +218,7 @@ func copyAndClose(dst *net.TCPConn, src *net.TCPConn) {
 	}
 }
 
-func handleTunnel(clientConn *net.TCPConn, serverConn *net.TCPConn) error {
+func sendConnectionEstablished(clientConn net.Conn) error {
 	response := &protocol.Response{
 		Protocol: "HTTP/1.1",
 		Code:     protocol.StatusOK,
@@ -109,95 +227,282 @@ func handleTunnel(clientConn *net.TCPConn, serverConn *net.TCPConn) error {
 			Headers: defaultResponseHeaders(),
 		},
 	}
-	err := response.WriteTo(clientConn)
+	return response.WriteTo(clientConn)
+}
+
+func handleTunnel(clientConn halfCloser, serverConn halfCloser) error {
+	err := sendConnectionEstablished(clientConn)
 	if err != nil {
+		serverConn.Close()
 		return err
 	}
-	log.Printf("established tunnel between %s and %s\n", clientConn.RemoteAddr(), serverConn.RemoteAddr())
-
-	go copyAndClose(clientConn, serverConn)
-	copyAndClose(serverConn, clientConn)
+	relayTunnel(clientConn, serverConn)
 	return nil
 }
 
-var tunnelAddrSchemeRegexp = regexp.MustCompile(`(.+):\d+`)
+// relayTunnel copies data both ways until both sides are closed
+func relayTunnel(clientConn halfCloser, serverConn halfCloser) {
+	log.Printf("established tunnel between %s and %s\n", clientConn.RemoteAddr(), serverConn.RemoteAddr())
+
+	timeout := time.Duration(currentSettings().TunnelIdleTimeout) * time.Second
+	setIdleTimeout(clientConn, timeout)
+	setIdleTimeout(serverConn, timeout)
+	activity := new(tunnelActivity)
+	activity.touch()
+
+	done := make(chan struct{})
+	go func() {
+		copyAndClose(clientConn, serverConn, timeout, activity)
+		close(done)
+	}()
+	copyAndClose(serverConn, clientConn, timeout, activity)
+	<-done
+	clientConn.Close()
+	serverConn.Close()
+}
 
-func tunnelAddrAllowed(addr string) bool {
-	match := tunnelAddrSchemeRegexp.FindStringSubmatch(addr)
-	if match == nil {
+func (settings *Settings) tunnelAddrAllowed(addr string) bool {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
 		return false
 	}
-	ips, err := net.LookupIP(match[1])
-	if err != nil {
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
 		return false
 	}
-	for _, ip := range ips {
-		if !ip.IsGlobalUnicast() {
-			return false
+	return host != "" && settings.allowedTunnelAddrRegexp.MatchString(addr)
+}
+
+type connState int
+
+const (
+	connClose connState = iota
+	connKeepAlive
+	connHijacked // the connection is owned by a tunnel now
+)
+
+func handleConnect(settings *Settings, clientConn *protocol.Conn, addr string) (*protocol.Error, connState) {
+	if !settings.tunnelAddrAllowed(addr) {
+		return &protocol.Error{protocol.StatusForbidden,
+			errors.New("This address isn't allowed for CONNECT")}, connClose
+	}
+
+	if settings.certificateAuthority != nil && !settings.interceptionBypassed(addr) {
+		err := handleInterceptedTunnel(settings.certificateAuthority, clientConn, addr, settings.username)
+		if err != nil {
+			return &protocol.Error{0, err}, connClose
 		}
+		return nil, connHijacked
 	}
 
-	return allowedTunnelAddrRegexp.MatchString(addr)
+	serverConn, err := dialTunnel(settings.destinations, settings.parentFor(addr), addr)
+	if err != nil {
+		return &protocol.Error{dialErrorStatus(err), err}, connClose
+	}
+	err = handleTunnel(clientConn, serverConn)
+	if err != nil {
+		return &protocol.Error{0, err}, connClose
+	}
+	return nil, connHijacked
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
 }
 
-func handleClient(clientConn net.Conn) (*protocol.Error, bool) {
+// handleClient serves a request read from clientConn. If tunnelAddr isn't empty,
+// clientConn is an intercepted TLS connection established by CONNECT to tunnelAddr.
+func handleClient(settings *Settings, clientConn *protocol.Conn, tunnelAddr string) (*protocol.Error, connState) {
 	request := new(protocol.Request)
 	err := request.ReadFrom(clientConn)
+	if err == io.EOF || err != nil && isTimeout(err) {
+		return nil, connClose
+	}
 	if err != nil {
-		return &protocol.Error{protocol.StatusBadRequest, err}, false
+		return &protocol.Error{protocol.ReadErrorStatus(err), err}, connClose
+	}
+	clientConn.SetReadDeadline(time.Time{})
+	if request.Body != nil {
+		defer request.Body.Reader.Close()
 	}
+	keepAlive := request.Persistent()
 
-	url := strings.TrimSpace(request.Url)
-	var addr string
-	if request.Method == protocol.MethodConnect {
-		addr = request.Url
-		if !tunnelAddrAllowed(addr) {
+	// Requests inside an intercepted tunnel are authorized by its CONNECT
+	if tunnelAddr == "" {
+		if !settings.clientListsFor(request.Method).Allows(clientConn.RemoteAddr()) {
 			return &protocol.Error{protocol.StatusForbidden,
-				errors.New("This address isn't allowed for CONNECT")}, false
+				fmt.Errorf("your network isn't allowed to send %s requests", request.Method)}, connClose
 		}
-	} else {
-		addr, request.Url, err = transformURL(request.Url)
+		username, err := settings.authenticate(request)
+		if err != nil {
+			return &protocol.Error{protocol.StatusProxyAuthRequired, err}, connClose
+		}
+		if username != "" {
+			log.Printf("%s is authenticated as %s\n", clientConn.RemoteAddr(), username)
+			settings = settings.forUser(username)
+		}
+	}
+
+	if tunnelAddr != "" {
+		if request.Method == protocol.MethodConnect {
+			return &protocol.Error{protocol.StatusBadRequest,
+				errors.New("CONNECT isn't allowed inside a tunnel")}, connClose
+		}
+		request.Url, err = interceptedURL(tunnelAddr, request.Url)
 		if err != nil {
-			return &protocol.Error{protocol.StatusBadRequest, err}, false
+			return &protocol.Error{protocol.StatusBadRequest, err}, connClose
 		}
+	} else if request.Method == protocol.MethodConnect {
+		return handleConnect(settings, clientConn, request.Url)
 	}
 
-	serverConn, err := net.Dial("tcp", addr)
+	originalURL := strings.TrimSpace(request.Url)
+	url, redirect := settings.rewriteURL(originalURL)
+	if redirect != 0 {
+		if request.DiscardBody() != nil {
+			keepAlive = false
+		}
+		err = sendRedirectResponse(clientConn, redirect, url, keepAlive)
+		if err != nil || !keepAlive {
+			return nil, connClose
+		}
+		return nil, connKeepAlive
+	}
+	addr, requestURI, secure, err := transformURL(url)
 	if err != nil {
-		return &protocol.Error{protocol.StatusBadGateway, err}, false
+		return &protocol.Error{protocol.StatusBadRequest, err}, connClose
+	}
+	if url != originalURL {
+		host, err := hostHeader(url)
+		if err != nil {
+			return &protocol.Error{protocol.StatusBadRequest, err}, connClose
+		}
+		request.SetHeader("Host", host)
 	}
-	if request.Method == protocol.MethodConnect {
-		err := handleTunnel(clientConn.(*net.TCPConn), serverConn.(*net.TCPConn))
+	request.Url = requestURI
+	if action, ruleText, ok := settings.findBlockRule(url, request); ok {
+		if request.DiscardBody() != nil {
+			keepAlive = false
+		}
+		err = sendBlockedResponse(settings, clientConn, url, request, action, ruleText, keepAlive)
+		if err != nil || !keepAlive {
+			return nil, connClose
+		}
+		return nil, connKeepAlive
+	}
+	rules := settings.matchingRules(url, request)
+	ModifyRequest(rules, request)
+	settings.rewriteHeaders(url, request, nil)
+	request.Upgrade = settings.upgradeAllowed(addr, request)
+
+	cacheKey := settings.cacheKey(url, rules)
+	requestTime := time.Now()
+	var cached *CachedResponse
+	if !request.Upgrade {
+		cached = responseCache.Lookup(cacheKey, request)
+	}
+	if cached != nil && cached.Fresh(request, requestTime) {
+		log.Printf("cache hit for %s\n", url)
+		return sendCachedResponse(settings, clientConn, url, request, cached.Response(request, requestTime), keepAlive)
+	}
+	if cached != nil && !cached.AddValidators(request) {
+		cached.Close()
+		cached = nil
+	}
+
+	upstream := Upstream{addr, secure, settings.parentFor(addr), settings.destinations}
+	if upstream.ForwardsRequests() {
+		request.Url = url
+		upstream.Parent.authorize(request)
+	}
+
+	var serverConn *protocol.Conn
+	var response *protocol.Response
+	var bodySent bool
+	for {
+		var reused bool
+		serverConn, reused, err = upstreamPool.Get(upstream,
+			time.Duration(settings.UpstreamConnectTimeout)*time.Second)
+		if err != nil {
+			return &protocol.Error{dialErrorStatus(err), err}, connClose
+		}
+
+		request.KeepAlive = upstreamPool.Enabled()
+		response, bodySent, err = forwardRequest(clientConn, serverConn, request,
+			time.Duration(settings.UpstreamResponseTimeout)*time.Second,
+			time.Duration(settings.ContinueTimeout)*time.Second)
+		if err == nil {
+			break
+		}
+		upstreamPool.Put(upstream, serverConn, false)
+		if !reused || !replayable(request) {
+			return &protocol.Error{protocol.StatusBadGateway, err}, connClose
+		}
+		log.Printf("reused connection to %s failed (%s), retrying\n", addr, err)
+	}
+	if response.Code == protocol.StatusSwitchingProtocols {
+		return switchProtocols(settings, clientConn, serverConn, upstream, url, request, response)
+	}
+	var serverReusable bool
+	defer func() { upstreamPool.Put(upstream, serverConn, serverReusable) }()
+
+	serverPersistent := response.Persistent() && response.Delimited()
+	responseTime := time.Now()
+	if !bodySent {
+		// Neither side can tell where the next message starts
+		serverPersistent = false
+		keepAlive = false
+	}
+
+	if cached != nil && response.Code == protocol.StatusNotModified {
+		log.Printf("cached response for %s is revalidated\n", url)
+		serverReusable = serverPersistent
+		cached, err = responseCache.Revalidated(cached, response, requestTime, responseTime)
 		if err != nil {
-			return &protocol.Error{0, err}, false
+			return &protocol.Error{protocol.StatusBadGateway, err}, connClose
 		}
-		return nil, true
+		return sendCachedResponse(settings, clientConn, url, request, cached.Response(request, responseTime), keepAlive)
+	}
+	if cached != nil {
+		cached.Close()
 	}
-	defer serverConn.Close()
 
-	err = request.WriteTo(serverConn)
+	err = ModifyResponse(rules, response)
 	if err != nil {
-		return &protocol.Error{protocol.StatusBadGateway, err}, false
+		return &protocol.Error{protocol.StatusBadGateway, err}, connClose
 	}
+	if request.Method != protocol.MethodGet && request.Method != protocol.MethodHead && response.Code < 400 {
+		responseCache.Invalidate(cacheKey)
+	}
+	responseCache.Capture(cacheKey, request, response, requestTime, responseTime)
+	settings.rewriteHeaders(url, request, response)
 
-	response := new(protocol.Response)
-	err = response.ReadFrom(serverConn)
-	if err != nil {
-		return &protocol.Error{protocol.StatusBadGateway, err}, false
+	if request.Protocol == "HTTP/1.0" && response.Chunked() {
+		response.SetDelimitedByClose()
 	}
-	err = ModifyResponse(url, response)
-	if err != nil {
-		return &protocol.Error{protocol.StatusBadGateway, err}, false
+	// Without a declared length the body would be delimited by closing the connection
+	if !response.Delimited() || connections.Closing() {
+		keepAlive = false
 	}
+	response.Protocol = "HTTP/1.1"
+	response.KeepAlive = keepAlive
 
 	err = response.WriteTo(clientConn)
 	if err != nil {
-		return &protocol.Error{0, err}, false
+		// Stop the goroutines that produce the body
+		if response.Body != nil {
+			response.Body.Reader.CloseWithError(err)
+		}
+		return &protocol.Error{0, err}, connClose
+	}
+	serverReusable = serverPersistent && response.DiscardBody() == nil
+	if !keepAlive || request.DiscardBody() != nil {
+		return nil, connClose
 	}
-	return nil, false
+	return nil, connKeepAlive
 }
 
-func sendErrorResponse(clientConn net.Conn, protocolErr *protocol.Error) error {
+func sendErrorResponse(settings *Settings, clientConn net.Conn, protocolErr *protocol.Error) error {
 	reason := protocol.StatusText[protocolErr.Status]
 	data := struct {
 		Status     int
@@ -210,7 +515,7 @@ func sendErrorResponse(clientConn net.Conn, protocolErr *protocol.Error) error {
 		Reason:     reason,
 		Error:      protocolErr.Error,
 		ServerName: ServerName,
-		Config:     config,
+		Config:     settings.Config,
 	}
 
 	response := &protocol.Response{
@@ -223,77 +528,317 @@ func sendErrorResponse(clientConn net.Conn, protocolErr *protocol.Error) error {
 			Body: protocol.NewPipe(),
 		},
 	}
+	if protocolErr.Status == protocol.StatusProxyAuthRequired {
+		response.AddHeader("Proxy-Authenticate", fmt.Sprintf(`Basic realm="%s"`, ServerName))
+	}
 	response.SetChunked(false)
-	go func() { response.Body.Writer.CloseWithError(errorTemplate.Execute(response.Body.Writer, data)) }()
+	go func() {
+		response.Body.Writer.CloseWithError(settings.errorTemplate.Execute(response.Body.Writer, data))
+	}()
 	return response.WriteTo(clientConn)
 }
 
-func runHandleClient(clientConn net.Conn) {
-	var keepConn bool
+// runHandleClient serves requests from a connection. Requests from an intercepted tunnel
+// are served with the policy of the user who has opened it, if any.
+func runHandleClient(rawConn net.Conn, tunnelAddr, username string) {
+	clientConn := protocol.NewConn(rawConn)
+	state := connKeepAlive
 	defer func() {
-		if !keepConn {
+		if state != connHijacked {
 			clientConn.Close()
 		}
 	}()
 
-	var protocolErr *protocol.Error
-	protocolErr, keepConn = handleClient(clientConn)
-	if protocolErr != nil {
-		log.Printf("error on handling a client (%d): %s\n", protocolErr.Status, protocolErr.Error)
-		if protocolErr.Status != 0 {
-			err := sendErrorResponse(clientConn, protocolErr)
+	if settings := currentSettings(); tunnelAddr == "" && !settings.clientAllowed(clientConn.RemoteAddr()) {
+		rejectClient(settings, clientConn)
+		return
+	}
+
+	for state == connKeepAlive {
+		// A reloaded config applies starting from the next request
+		settings := currentSettings()
+		if username != "" {
+			if settings.credentials == nil || !settings.credentials.Has(username) {
+				log.Printf("user %s is removed, closing the tunnel\n", username)
+				return
+			}
+			settings = settings.forUser(username)
+		}
+		if !waitForRequest(settings, clientConn) {
+			return
+		}
+
+		var protocolErr *protocol.Error
+		protocolErr, state = handleClient(settings, clientConn, tunnelAddr)
+		if protocolErr != nil {
+			log.Printf("error on handling a client (%d): %s\n", protocolErr.Status, protocolErr.Error)
+			if protocolErr.Status != 0 {
+				err := sendErrorResponse(settings, clientConn, protocolErr)
+				if err != nil {
+					log.Println("error on sending a error response: " + err.Error())
+				}
+			}
+		}
+	}
+}
+
+// waitForRequest waits until the client starts to send the next request and limits the time
+// to receive its headers. It returns false if the connection should be closed instead.
+func waitForRequest(settings *Settings, clientConn *protocol.Conn) bool {
+	tracked := trackedConn(clientConn)
+	if tracked != nil && tracked.tracker != nil {
+		if !tracked.tracker.setWaiting(tracked, true) {
+			return false
+		}
+		defer tracked.tracker.setWaiting(tracked, false)
+	}
+
+	if settings.KeepAliveTimeout > 0 {
+		clientConn.SetReadDeadline(time.Now().Add(time.Duration(settings.KeepAliveTimeout) * time.Second))
+	}
+	if _, err := clientConn.Reader.Peek(1); err != nil {
+		return false
+	}
+	var headersDeadline time.Time
+	if settings.HeaderReadTimeout > 0 {
+		headersDeadline = time.Now().Add(time.Duration(settings.HeaderReadTimeout) * time.Second)
+	}
+	clientConn.SetReadDeadline(headersDeadline)
+	return true
+}
+
+// compileURLRules compiles the rules that rewrite pages
+func compileURLRules(removeElements map[string][]string, injectElements map[string][]InjectionConfig) ([]URLRule, error) {
+	var rules []URLRule
+	for expr, selectors := range removeElements {
+		pattern, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("can't compile a regexp from RemoveElements: %s", err)
+		}
+		rule := URLRule{Pattern: pattern, Selectors: selectors}
+		for _, selector := range selectors {
+			matcher, err := cascadia.Compile(selector)
 			if err != nil {
-				log.Println("error on sending a error response: " + err.Error())
+				return nil, fmt.Errorf("can't compile a CSS selector: %s", err)
 			}
+			rule.Matchers = append(rule.Matchers, matcher)
+			rule.Lookahead = rule.Lookahead || needsLookahead(selector)
 		}
+		rules = append(rules, rule)
 	}
+	for expr, injectionConfigs := range injectElements {
+		pattern, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, fmt.Errorf("can't compile a regexp from InjectElements: %s", err)
+		}
+		rule := URLRule{Pattern: pattern}
+		for _, injectionConfig := range injectionConfigs {
+			injection, err := compileInjection(injectionConfig)
+			if err != nil {
+				return nil, fmt.Errorf("invalid rule in InjectElements: %s", err)
+			}
+			rule.Injections = append(rule.Injections, injection)
+			rule.Lookahead = rule.Lookahead || injection.Lookahead
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
 }
 
-func loadConfig() error {
-	err := loadData(configFilename, &config)
+// loadSettings loads and checks the config. The previous settings, if any,
+// are used to keep the loaded CA instead of reading it again.
+func loadSettings(previous *Settings) (*Settings, error) {
+	settings := new(Settings)
+	config := &settings.Config
+	err := loadData(configFilename, config)
+	if err != nil {
+		return nil, fmt.Errorf("can't load %s: %s", configFilename, err)
+	}
+
+	settings.allowedTunnelAddrRegexp, err = regexp.Compile(config.AllowTunnelsTo)
+	if err != nil {
+		return nil, fmt.Errorf("can't compile a regexp from AllowTunnelsTo: %s", err)
+	}
+
+	settings.allowedUpgradeAddrRegexp, err = regexp.Compile(config.AllowUpgradesTo)
 	if err != nil {
-		return fmt.Errorf("can't load %s: %s", configFilename, err)
+		return nil, fmt.Errorf("can't compile a regexp from AllowUpgradesTo: %s", err)
 	}
 
-	allowedTunnelAddrRegexp, err = regexp.Compile(config.AllowTunnelsTo)
+	settings.httpClients, err = compileClientLists(config.AllowClients, config.DenyClients)
 	if err != nil {
-		return fmt.Errorf("can't compile a regexp from AllowTunnelsTo: %s", err)
+		return nil, fmt.Errorf("invalid network in AllowClients or DenyClients: %s", err)
+	}
+	settings.tunnelClients, err = compileClientLists(config.AllowTunnelClients, config.DenyTunnelClients)
+	if err != nil {
+		return nil, fmt.Errorf("invalid network in AllowTunnelClients or DenyTunnelClients: %s", err)
+	}
+	settings.destinations, err = compileDestinationPolicy(config.DenyDestinations, config.AllowDestinations)
+	if err != nil {
+		return nil, fmt.Errorf("invalid network in DenyDestinations or AllowDestinations: %s", err)
 	}
 
-	for expr, selectors := range config.RemoveElements {
+	if config.KeepAliveTimeout < 0 {
+		return nil, errors.New("KeepAliveTimeout can't be negative")
+	}
+	if config.HeaderReadTimeout < 0 || config.BodyIdleTimeout < 0 || config.UpstreamConnectTimeout < 0 ||
+		config.UpstreamResponseTimeout < 0 || config.TunnelIdleTimeout < 0 || config.ContinueTimeout < 0 ||
+		config.ShutdownTimeout < 0 {
+		return nil, errors.New("timeouts can't be negative")
+	}
+	if config.MaxConnections < 0 || config.MaxConnectionsPerClient < 0 {
+		return nil, errors.New("connection limits can't be negative")
+	}
+	if config.MaxHeaderBytes < 0 || config.MaxHeaderCount < 0 {
+		return nil, errors.New("header limits can't be negative")
+	}
+	if config.PoolMaxIdle < 0 || config.PoolMaxConnsPerHost < 0 || config.PoolIdleTimeout < 0 {
+		return nil, errors.New("connection pool limits can't be negative")
+	}
+	if config.CacheMemorySize < 0 || config.CacheDiskSize < 0 {
+		return nil, errors.New("cache limits can't be negative")
+	}
+	if config.CacheDiskSize > 0 && config.CacheDir == "" {
+		return nil, errors.New("CacheDir is required to cache on disk")
+	}
+
+	for _, expr := range config.DontInterceptTunnelsTo {
 		pattern, err := regexp.Compile(expr)
 		if err != nil {
-			return fmt.Errorf("can't compile a regexp from RemoveElements: %s", err)
+			return nil, fmt.Errorf("can't compile a regexp from DontInterceptTunnelsTo: %s", err)
 		}
-		for _, selector := range selectors {
-			_, err := cascadia.Compile(selector)
+		settings.interceptionBypassRegexps = append(settings.interceptionBypassRegexps, pattern)
+	}
+	if config.InterceptTunnels {
+		if previous != nil && previous.certificateAuthority != nil &&
+			previous.CACertificate == config.CACertificate && previous.CAKey == config.CAKey {
+			settings.certificateAuthority = previous.certificateAuthority
+		} else {
+			settings.certificateAuthority, err = LoadOrCreateCA(
+				resolveConfigPath(config.CACertificate), resolveConfigPath(config.CAKey))
 			if err != nil {
-				return fmt.Errorf("can't compile a CSS selector: %s", err)
+				return nil, fmt.Errorf("can't load the CA for tunnel interception: %s", err)
 			}
 		}
-		urlRules = append(urlRules, URLRule{pattern, selectors})
+	}
+
+	settings.parents, err = compileParents(config.Parents)
+	if err != nil {
+		return nil, err
+	}
+	for _, routeConfig := range config.Routes {
+		route, err := compileRoute(routeConfig, settings.parents)
+		if err != nil {
+			return nil, fmt.Errorf("invalid route in Routes: %s", err)
+		}
+		settings.routes = append(settings.routes, route)
+	}
+
+	settings.urlRules, err = compileURLRules(config.RemoveElements, config.InjectElements)
+	if err != nil {
+		return nil, err
+	}
+	settings.blockRules, err = compileBlockRules(config.BlockRequests)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkQueryParamPatterns(config.StripQueryParams)
+	if err != nil {
+		return nil, fmt.Errorf("can't use StripQueryParams: %s", err)
+	}
+	for _, rewriteConfig := range config.RewriteURLs {
+		rewrite, err := compileURLRewrite(rewriteConfig)
+		if err != nil {
+			return nil, fmt.Errorf("can't compile a rule from RewriteURLs: %s", err)
+		}
+		settings.urlRewrites = append(settings.urlRewrites, rewrite)
+	}
+
+	for _, ruleConfig := range config.RewriteHeaders {
+		rule, err := compileHeaderRule(ruleConfig)
+		if err != nil {
+			return nil, fmt.Errorf("can't compile a rule from RewriteHeaders: %s", err)
+		}
+		settings.headerRules = append(settings.headerRules, rule)
+	}
+
+	if len(config.FilterLists) > 0 {
+		settings.filterList, err = loadFilterLists(config.FilterLists)
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("filter lists loaded: %d network rules, %d element hiding rules, %d unsupported rules skipped\n",
+			settings.filterList.NetworkRules, settings.filterList.HidingRules, settings.filterList.Skipped)
+	}
+
+	settings.rulesVersion, err = rulesVersion(config)
+	if err != nil {
+		return nil, fmt.Errorf("can't calculate the rule set version: %s", err)
+	}
+
+	settings.errorTemplate, err = loadTemplate("error.tpl")
+	if err != nil {
+		return nil, err
+	}
+	settings.blockTemplate, err = loadTemplate("blocked.tpl")
+	if err != nil {
+		return nil, err
+	}
+
+	if config.CredentialsFile != "" {
+		settings.credentials, err = loadCredentials(resolveConfigPath(config.CredentialsFile))
+		if err != nil {
+			return nil, fmt.Errorf("can't load the credentials: %s", err)
+		}
+	}
+	// The settings of users are copies, so everything else has to be loaded before
+	settings.users = make(map[string]*Settings)
+	for username, userConfig := range config.Users {
+		settings.users[username], err = settings.withUserPolicy(userConfig)
+		if err != nil {
+			return nil, fmt.Errorf("invalid policy of user %s: %s", username, err)
+		}
 	}
 
 	log.Println("config checked")
-	return nil
+	return settings, nil
 }
 
 func main() {
-	err := loadConfig()
+	settings, err := loadSettings(nil)
 	if err != nil {
 		log.Fatalln(err)
 	}
-
-	log.Printf("listening on %s\n", config.ListenOn)
-	ln, err := net.Listen("tcp", config.ListenOn)
-	if err != nil {
-		log.Fatal("listen failed:", err.Error())
-	}
-	for {
-		conn, err := ln.Accept()
+	storeSettings(settings)
+	go watchSettings()
+	go checkParents()
+
+	upstreamPool = NewConnPool(settings.PoolMaxIdle, settings.PoolMaxConnsPerHost,
+		time.Duration(settings.PoolIdleTimeout)*time.Second)
+	if settings.CacheMemorySize > 0 || settings.CacheDiskSize > 0 {
+		responseCache, err = NewResponseCache(int64(settings.CacheMemorySize)<<20, int64(settings.CacheDiskSize)<<20,
+			resolveConfigPath(settings.CacheDir))
 		if err != nil {
-			log.Fatal("accept failed:", err.Error())
+			log.Fatalln("can't open the cache:", err)
 		}
-		go runHandleClient(conn)
+	}
+
+	if settings.SocksListenOn != "" {
+		go listenSocks(settings.SocksListenOn)
+	}
+	if settings.ListenOnUnix != "" {
+		go listenUnix(settings.ListenOnUnix)
+	}
+
+	log.Printf("listening on %s\n", settings.ListenOn)
+	ln := connections.listen("tcp", settings.ListenOn)
+	go connections.serve(ln, func(conn net.Conn) { runHandleClient(conn, "", "") })
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	<-signals
+	if !connections.Shutdown(time.Duration(currentSettings().ShutdownTimeout) * time.Second) {
+		log.Println("connections are still open after ShutdownTimeout, exiting anyway")
 	}
 }
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"./protocol"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func init() {
+	// Requests and rule matches are logged
+	log.SetOutput(ioutil.Discard)
+}
+
+// bufferConn is a connection that reads the given data and keeps what is written
+type bufferConn struct {
+	net.Conn
+	reader  io.Reader
+	written bytes.Buffer
+}
+
+func newBufferConn(data string) *bufferConn {
+	return &bufferConn{reader: strings.NewReader(data)}
+}
+
+func (conn *bufferConn) Read(b []byte) (int, error) {
+	return conn.reader.Read(b)
+}
+
+func (conn *bufferConn) Write(b []byte) (int, error) {
+	return conn.written.Write(b)
+}
+
+func (conn *bufferConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+}
+
+func (conn *bufferConn) Close() error {
+	return nil
+}
+
+// The data is available at once, so deadlines don't matter
+func (conn *bufferConn) SetDeadline(t time.Time) error      { return nil }
+func (conn *bufferConn) SetReadDeadline(t time.Time) error  { return nil }
+func (conn *bufferConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// loadTestSettings loads the settings from a config with the given fields and the shipped templates
+func loadTestSettings(t *testing.T, config map[string]interface{}) *Settings {
+	data, err := json.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "config.json")
+	if err := ioutil.WriteFile(filename, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	savedConfig, savedTemplates := configFilename, templateDir
+	configFilename, templateDir = filename, "templates"
+	defer func() { configFilename, templateDir = savedConfig, savedTemplates }()
+
+	settings, err := loadSettings(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return settings
+}
+
+// readRequest parses a request as ReadFrom does for a client
+func readRequest(t *testing.T, data string) *protocol.Request {
+	request := new(protocol.Request)
+	if err := request.ReadFrom(newBufferConn(data)); err != nil {
+		t.Fatal(err)
+	}
+	return request
+}
+
+// readResponse parses what the proxy has written to a connection
+func readResponse(t *testing.T, conn *bufferConn, requestMethod string) (*protocol.Response, string) {
+	response := new(protocol.Response)
+	if err := response.ReadFrom(newBufferConn(conn.written.String()), requestMethod); err != nil {
+		t.Fatal(err)
+	}
+	var body []byte
+	if response.Body != nil {
+		var err error
+		body, err = ioutil.ReadAll(response.Body.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return response, string(body)
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"./protocol"
+	"container/list"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	caValidity   = 10 * 365 * 24 * time.Hour
+	leafValidity = 365 * 24 * time.Hour
+
+	// Clients choose the names, so only the recently used certificates are kept
+	maxCachedCertificates = 1000
+)
+
+type CertificateAuthority struct {
+	Cert *x509.Certificate
+	Key  crypto.Signer
+
+	mutex sync.Mutex
+	cache map[string]*list.Element // of cachedCertificate
+	lru   *list.List               // the front is the most recently used certificate
+}
+
+type cachedCertificate struct {
+	host string
+	cert *tls.Certificate
+}
+
+func newCertificateAuthority(cert *x509.Certificate, key crypto.Signer) *CertificateAuthority {
+	return &CertificateAuthority{Cert: cert, Key: key, cache: make(map[string]*list.Element), lru: list.New()}
+}
+
+func resolveConfigPath(filename string) string {
+	if filepath.IsAbs(filename) {
+		return filename
+	}
+	return filepath.Join(executableDir, filename)
+}
+
+func randomSerialNumber() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
+
+func writePEM(filename, blockType string, data []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return pem.Encode(f, &pem.Block{Type: blockType, Bytes: data})
+}
+
+func readPEM(filename, blockType string) ([]byte, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != blockType {
+		return nil, fmt.Errorf("%s doesn't contain a %s PEM block", filename, blockType)
+	}
+	return block.Bytes, nil
+}
+
+func createCA(certFilename, keyFilename string) (*CertificateAuthority, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := randomSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: ServerName + " CA", Organization: []string{ServerName}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(caValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	err = writePEM(keyFilename, "PRIVATE KEY", keyDER, 0600)
+	if err != nil {
+		return nil, err
+	}
+	err = writePEM(certFilename, "CERTIFICATE", der, 0644)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("generated a new CA certificate %s, install it into your browser\n", certFilename)
+	return newCertificateAuthority(cert, key), nil
+}
+
+func LoadOrCreateCA(certFilename, keyFilename string) (*CertificateAuthority, error) {
+	certDER, err := readPEM(certFilename, "CERTIFICATE")
+	if os.IsNotExist(err) {
+		return createCA(certFilename, keyFilename)
+	}
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(certDER)
+	if err != nil {
+		return nil, err
+	}
+	if !cert.IsCA {
+		return nil, fmt.Errorf("%s isn't a CA certificate", certFilename)
+	}
+
+	keyDER, err := readPEM(keyFilename, "PRIVATE KEY")
+	if err != nil {
+		return nil, err
+	}
+	parsedKey, err := x509.ParsePKCS8PrivateKey(keyDER)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsedKey.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%s contains an unsupported private key", keyFilename)
+	}
+	return newCertificateAuthority(cert, key), nil
+}
+
+func (ca *CertificateAuthority) createLeaf(host string) (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := randomSerialNumber()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host, Organization: []string{ServerName}},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(leafValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.Cert, key.Public(), ca.Key)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{der, ca.Cert.Raw},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+// validHostname accepts IP addresses and DNS names made of letters, digits, hyphens and underscores
+func validHostname(host string) bool {
+	if net.ParseIP(host) != nil {
+		return true
+	}
+	if host == "" || len(host) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(host, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (ca *CertificateAuthority) Certificate(host string) (*tls.Certificate, error) {
+	host = strings.ToLower(host)
+	if !validHostname(host) {
+		return nil, fmt.Errorf("invalid host name %q", host)
+	}
+
+	ca.mutex.Lock()
+	defer ca.mutex.Unlock()
+
+	if element, ok := ca.cache[host]; ok {
+		cert := element.Value.(*cachedCertificate).cert
+		if time.Now().Before(cert.Leaf.NotAfter) {
+			ca.lru.MoveToFront(element)
+			return cert, nil
+		}
+		ca.lru.Remove(element)
+		delete(ca.cache, host)
+	}
+	cert, err := ca.createLeaf(host)
+	if err != nil {
+		return nil, err
+	}
+	ca.cache[host] = ca.lru.PushFront(&cachedCertificate{host, cert})
+	if ca.lru.Len() > maxCachedCertificates {
+		oldest := ca.lru.Back()
+		ca.lru.Remove(oldest)
+		delete(ca.cache, oldest.Value.(*cachedCertificate).host)
+	}
+	return cert, nil
+}
+
+func (settings *Settings) interceptionBypassed(addr string) bool {
+	for _, pattern := range settings.interceptionBypassRegexps {
+		if pattern.MatchString(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+func handleInterceptedTunnel(ca *CertificateAuthority, clientConn *protocol.Conn, addr, username string) error {
+	err := sendConnectionEstablished(clientConn)
+	if err != nil {
+		return err
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	tlsConn := tls.Server(clientConn, &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			name := hello.ServerName
+			if name == "" {
+				name = host
+			}
+			return ca.Certificate(name)
+		},
+		NextProtos: []string{"http/1.1"},
+	})
+	err = tlsConn.Handshake()
+	if err != nil {
+		return errors.New("TLS handshake with the client failed: " + err.Error())
+	}
+	log.Printf("intercepting tunnel from %s to %s\n", clientConn.RemoteAddr(), addr)
+
+	runHandleClient(tlsConn, addr, username)
+	return nil
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"./protocol"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// Types of parent proxies
+const (
+	ParentHTTP   = "http"
+	ParentSOCKS5 = "socks5"
+)
+
+// DirectRoute may be listed in Via of a route to connect without a parent
+const DirectRoute = "direct"
+
+const (
+	parentCheckInterval = 10 * time.Second
+	parentCheckTimeout  = 5 * time.Second
+)
+
+type ParentConfig struct {
+	Name, Type, Addr   string
+	Username, Password string
+}
+
+type RouteConfig struct {
+	Destination string   // a regexp matched against host:port
+	Via         []string // names of parents in the order of preference
+}
+
+type Parent struct {
+	ParentConfig
+}
+
+type Route struct {
+	Destination *regexp.Regexp
+	Via         []*Parent // nil stands for a direct connection
+}
+
+func compileParents(parentConfigs []ParentConfig) (map[string]*Parent, error) {
+	parents := make(map[string]*Parent)
+	for _, parentConfig := range parentConfigs {
+		if parentConfig.Name == "" || parentConfig.Name == DirectRoute {
+			return nil, fmt.Errorf(`parent name "%s" isn't allowed`, parentConfig.Name)
+		}
+		if parents[parentConfig.Name] != nil {
+			return nil, fmt.Errorf("parent %s is defined twice", parentConfig.Name)
+		}
+		if parentConfig.Type != ParentHTTP && parentConfig.Type != ParentSOCKS5 {
+			return nil, fmt.Errorf("parent %s has unknown type %s", parentConfig.Name, parentConfig.Type)
+		}
+		if _, _, err := net.SplitHostPort(parentConfig.Addr); err != nil {
+			return nil, fmt.Errorf("parent %s has invalid address: %s", parentConfig.Name, err)
+		}
+		parents[parentConfig.Name] = &Parent{parentConfig}
+	}
+	return parents, nil
+}
+
+func compileRoute(routeConfig RouteConfig, parents map[string]*Parent) (Route, error) {
+	destination, err := regexp.Compile(routeConfig.Destination)
+	if err != nil {
+		return Route{}, err
+	}
+	if len(routeConfig.Via) == 0 {
+		return Route{}, fmt.Errorf("route for %s has empty Via", routeConfig.Destination)
+	}
+	route := Route{Destination: destination}
+	for _, name := range routeConfig.Via {
+		parent, ok := parents[name]
+		if !ok && name != DirectRoute {
+			return Route{}, fmt.Errorf("unknown parent %s", name)
+		}
+		route.Via = append(route.Via, parent)
+	}
+	return route, nil
+}
+
+// The health of parents is kept apart from the settings, so it survives reloads
+var parentHealth = struct {
+	sync.Mutex
+	down map[string]bool
+}{down: make(map[string]bool)}
+
+func (parent *Parent) healthy() bool {
+	parentHealth.Lock()
+	defer parentHealth.Unlock()
+	return !parentHealth.down[parent.Addr]
+}
+
+func (parent *Parent) setHealthy(healthy bool) {
+	parentHealth.Lock()
+	defer parentHealth.Unlock()
+	if parentHealth.down[parent.Addr] == !healthy {
+		return
+	}
+	if healthy {
+		delete(parentHealth.down, parent.Addr)
+		log.Printf("parent %s (%s) is up\n", parent.Name, parent.Addr)
+	} else {
+		parentHealth.down[parent.Addr] = true
+		log.Printf("parent %s (%s) is down\n", parent.Name, parent.Addr)
+	}
+}
+
+// checkParents tries to connect to every parent periodically, so routes fail over to the next parent
+// while one is down and return to it when it's up again.
+func checkParents() {
+	for range time.Tick(parentCheckInterval) {
+		for _, parent := range currentSettings().parents {
+			conn, err := net.DialTimeout("tcp", parent.Addr, parentCheckTimeout)
+			if err == nil {
+				conn.Close()
+			}
+			parent.setHealthy(err == nil)
+		}
+	}
+}
+
+// parentFor returns the parent to reach addr through, or nil for a direct connection
+func (settings *Settings) parentFor(addr string) *Parent {
+	for _, route := range settings.routes {
+		if !route.Destination.MatchString(addr) {
+			continue
+		}
+		for _, parent := range route.Via {
+			if parent == nil || parent.healthy() {
+				return parent
+			}
+		}
+		// Every parent seems to be down, but the last health check may be outdated
+		return route.Via[0]
+	}
+	return nil
+}
+
+func (parent *Parent) dial() (*protocol.Conn, error) {
+	ctx, cancel := connectContext()
+	defer cancel()
+	conn, err := dialServer(ctx, parent.Addr)
+	if err != nil {
+		parent.setHealthy(false)
+		return nil, fmt.Errorf("can't connect to parent %s: %s", parent.Name, err)
+	}
+	return protocol.NewConn(conn), nil
+}
+
+// authorize adds the credentials for an HTTP parent to a request
+func (parent *Parent) authorize(request *protocol.Request) {
+	if parent.Username == "" {
+		return
+	}
+	credentials := base64.StdEncoding.EncodeToString([]byte(parent.Username + ":" + parent.Password))
+	request.SetHeader("Proxy-Authorization", "Basic "+credentials)
+}
+
+// connect asks an HTTP parent on conn to open a tunnel to addr
+func (parent *Parent) connect(conn *protocol.Conn, addr string) error {
+	request := &protocol.Request{
+		Method:   protocol.MethodConnect,
+		Url:      addr,
+		Protocol: "HTTP/1.1",
+		MessageBase: protocol.MessageBase{
+			Headers:   []protocol.Header{{"Host", addr}},
+			KeepAlive: true,
+		},
+	}
+	parent.authorize(request)
+	err := request.WriteTo(conn)
+	if err != nil {
+		return err
+	}
+	response := new(protocol.Response)
+	err = response.ReadFrom(conn, protocol.MethodConnect)
+	if err != nil {
+		return err
+	}
+	if response.Code/100 != 2 {
+		return fmt.Errorf("parent %s refused to connect to %s: %d %s", parent.Name, addr, response.Code, response.Reason)
+	}
+	return nil
+}
+
+// dialTunnel connects to addr directly if parent is nil, or opens a tunnel through the parent.
+// Destinations are checked only for direct connections, a parent resolves the host itself.
+func dialTunnel(destinations *DestinationPolicy, parent *Parent, addr string) (*protocol.Conn, error) {
+	if parent == nil {
+		conn, err := destinations.Dial(addr)
+		if err != nil {
+			return nil, err
+		}
+		return protocol.NewConn(conn), nil
+	}
+
+	conn, err := parent.dial()
+	if err != nil {
+		return nil, err
+	}
+	if parent.Type == ParentSOCKS5 {
+		err = socksConnect(conn, conn.Reader, addr, parent.Username, parent.Password)
+	} else {
+		err = parent.connect(conn, addr)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Upstream tells how to reach an origin server
+type Upstream struct {
+	Addr         string
+	Secure       bool
+	Parent       *Parent // nil for a direct connection
+	Destinations *DestinationPolicy
+}
+
+// ForwardsRequests tells whether requests are sent to an HTTP parent in absolute form.
+// Otherwise they are sent to the origin, through a tunnel if there is a parent.
+func (upstream Upstream) ForwardsRequests() bool {
+	return upstream.Parent != nil && upstream.Parent.Type == ParentHTTP && !upstream.Secure
+}
+
+func (upstream Upstream) Dial() (net.Conn, error) {
+	var conn *protocol.Conn
+	var err error
+	if upstream.ForwardsRequests() {
+		conn, err = upstream.Parent.dial()
+	} else {
+		conn, err = dialTunnel(upstream.Destinations, upstream.Parent, upstream.Addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !upstream.Secure {
+		return conn, nil
+	}
+
+	host, _, err := net.SplitHostPort(upstream.Addr)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: host})
+	if timeout := currentSettings().UpstreamConnectTimeout; timeout > 0 {
+		conn.SetDeadline(time.Now().Add(time.Duration(timeout) * time.Second))
+	}
+	err = tlsConn.Handshake()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"./protocol"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+type idleConn struct {
+	conn  *protocol.Conn
+	since time.Time
+}
+
+type PoolStats struct {
+	Dialed, Reused, Expired int
+}
+
+// ConnPool keeps idle connections to origin servers for reuse.
+// A zero MaxIdle disables pooling, so every connection is closed after use.
+type ConnPool struct {
+	MaxIdle, MaxConnsPerHost int
+	IdleTimeout              time.Duration
+
+	mutex    sync.Mutex
+	released *sync.Cond
+	idle     map[string][]idleConn
+	idleSize int
+	active   map[string]int
+	stats    PoolStats
+}
+
+var upstreamPool *ConnPool
+
+var errPoolWaitTimeout = errors.New("timed out waiting for a free connection to the origin")
+
+func NewConnPool(maxIdle, maxConnsPerHost int, idleTimeout time.Duration) *ConnPool {
+	pool := &ConnPool{
+		MaxIdle:         maxIdle,
+		MaxConnsPerHost: maxConnsPerHost,
+		IdleTimeout:     idleTimeout,
+		idle:            make(map[string][]idleConn),
+		active:          make(map[string]int),
+	}
+	pool.released = sync.NewCond(&pool.mutex)
+	if maxIdle > 0 && idleTimeout > 0 {
+		go pool.expireLoop()
+	}
+	return pool
+}
+
+func poolKey(upstream Upstream) string {
+	key := "http://" + upstream.Addr
+	if upstream.Secure {
+		key = "https://" + upstream.Addr
+	}
+	if upstream.Parent != nil {
+		key += " via " + upstream.Parent.Type + "://" + upstream.Parent.Addr
+	}
+	return key
+}
+
+func (pool *ConnPool) Enabled() bool {
+	return pool.MaxIdle > 0
+}
+
+func (pool *ConnPool) takeIdle(key string) *protocol.Conn {
+	conns := pool.idle[key]
+	for len(conns) > 0 {
+		item := conns[len(conns)-1]
+		conns = conns[:len(conns)-1]
+		pool.idleSize--
+		if pool.IdleTimeout > 0 && time.Since(item.since) > pool.IdleTimeout {
+			item.conn.Close()
+			pool.active[key]--
+			if pool.active[key] <= 0 {
+				delete(pool.active, key)
+			}
+			pool.stats.Expired++
+			continue
+		}
+		pool.idle[key] = conns
+		return item.conn
+	}
+	delete(pool.idle, key)
+	return nil
+}
+
+// Get returns an idle connection to the upstream if there is one, or dials a new one.
+// The second result tells whether the connection was reused. If MaxConnsPerHost connections
+// are in use, Get waits for one of them up to the timeout, zero meaning no limit.
+func (pool *ConnPool) Get(upstream Upstream, timeout time.Duration) (*protocol.Conn, bool, error) {
+	key := poolKey(upstream)
+
+	var expired bool
+	if timeout > 0 {
+		// The mutex is held while broadcasting, so the wakeup can't be missed between the check and Wait
+		timer := time.AfterFunc(timeout, func() {
+			pool.mutex.Lock()
+			expired = true
+			pool.released.Broadcast()
+			pool.mutex.Unlock()
+		})
+		defer timer.Stop()
+	}
+
+	pool.mutex.Lock()
+	for {
+		if conn := pool.takeIdle(key); conn != nil {
+			pool.stats.Reused++
+			pool.mutex.Unlock()
+			return conn, true, nil
+		}
+		if pool.MaxConnsPerHost <= 0 || pool.active[key] < pool.MaxConnsPerHost {
+			break
+		}
+		if expired {
+			pool.mutex.Unlock()
+			return nil, false, errPoolWaitTimeout
+		}
+		pool.released.Wait()
+	}
+	pool.active[key]++
+	pool.stats.Dialed++
+	pool.mutex.Unlock()
+
+	conn, err := upstream.Dial()
+	if err != nil {
+		pool.forget(key)
+		return nil, false, err
+	}
+	return protocol.NewConn(conn), false, nil
+}
+
+func (pool *ConnPool) forget(key string) {
+	pool.mutex.Lock()
+	pool.active[key]--
+	if pool.active[key] <= 0 {
+		delete(pool.active, key)
+	}
+	pool.mutex.Unlock()
+	pool.released.Broadcast()
+}
+
+// Release removes a connection obtained by Get from the pool without closing it,
+// as it isn't used for HTTP anymore.
+func (pool *ConnPool) Release(upstream Upstream) {
+	pool.forget(poolKey(upstream))
+}
+
+// Put returns a connection obtained by Get. It's kept for reuse only if reusable is true,
+// i.e. the response was read completely and the origin didn't ask to close the connection.
+func (pool *ConnPool) Put(upstream Upstream, conn *protocol.Conn, reusable bool) {
+	key := poolKey(upstream)
+	if reusable && pool.Enabled() {
+		pool.mutex.Lock()
+		if pool.idleSize < pool.MaxIdle {
+			pool.idle[key] = append(pool.idle[key], idleConn{conn, time.Now()})
+			pool.idleSize++
+			pool.mutex.Unlock()
+			pool.released.Broadcast()
+			return
+		}
+		pool.mutex.Unlock()
+	}
+
+	conn.Close()
+	pool.forget(key)
+}
+
+func (pool *ConnPool) expire() {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	for key, conns := range pool.idle {
+		var kept []idleConn
+		for _, item := range conns {
+			if time.Since(item.since) > pool.IdleTimeout {
+				item.conn.Close()
+				pool.idleSize--
+				pool.active[key]--
+				pool.stats.Expired++
+			} else {
+				kept = append(kept, item)
+			}
+		}
+		if kept == nil {
+			delete(pool.idle, key)
+		} else {
+			pool.idle[key] = kept
+		}
+		if pool.active[key] <= 0 {
+			delete(pool.active, key)
+		}
+	}
+	pool.released.Broadcast()
+}
+
+func (pool *ConnPool) logStats() {
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	total := 0
+	for _, count := range pool.active {
+		total += count
+	}
+	log.Printf("upstream pool: %d connections (%d idle) to %d origins, %d dialed, %d reused, %d expired\n",
+		total, pool.idleSize, len(pool.active), pool.stats.Dialed, pool.stats.Reused, pool.stats.Expired)
+}
+
+func (pool *ConnPool) expireLoop() {
+	var lastStats PoolStats
+	for range time.Tick(pool.IdleTimeout) {
+		pool.expire()
+
+		pool.mutex.Lock()
+		changed := pool.stats != lastStats
+		lastStats = pool.stats
+		pool.mutex.Unlock()
+		if changed {
+			pool.logStats()
+		}
+	}
+}
+
+// Methods that may be retried automatically (RFC 7231, section 4.2.2)
+var idempotentMethods = map[string]bool{
+	"GET": true, "HEAD": true, "OPTIONS": true, "TRACE": true, "PUT": true, "DELETE": true,
+}
+
+// replayable tells whether a request can be sent again on a fresh connection
+// after a reused one turned out to be closed by the origin. Only idempotent requests
+// without a body are retried (RFC 7230, section 6.3.1).
+func replayable(request *protocol.Request) bool {
+	if !idempotentMethods[request.Method] || request.Chunked() {
+		return false
+	}
+	value, ok := request.Header("Content-Length")
+	return !ok || value == "0"
+}
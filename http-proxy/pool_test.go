@@ -0,0 +1,204 @@
+package main
+
+import (
+	"./protocol"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testOrigin serves requests with "ok" and closes every connection after the first response
+// without announcing it, like an origin closing idle connections. It counts the connections.
+func testOrigin(t *testing.T) (string, *int32) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	var accepted int32
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+			go func() {
+				defer conn.Close()
+				request := new(protocol.Request)
+				if request.ReadFrom(conn) != nil || request.DiscardBody() != nil {
+					return
+				}
+				conn.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"))
+			}()
+		}
+	}()
+	return listener.Addr().String(), &accepted
+}
+
+func testUpstream(t *testing.T, addr string) Upstream {
+	policy, err := compileDestinationPolicy(nil, []string{"127.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Upstream{Addr: addr, Destinations: policy}
+}
+
+func TestPoolReuse(t *testing.T) {
+	storeSettings(&Settings{})
+	addr, accepted := testOrigin(t)
+	upstream := testUpstream(t, addr)
+	pool := NewConnPool(2, 0, 0)
+
+	conn, reused, err := pool.Get(upstream, 0)
+	if err != nil || reused {
+		t.Fatalf("got reused %v, error %v for the first connection", reused, err)
+	}
+	pool.Put(upstream, conn, true)
+	again, reused, err := pool.Get(upstream, 0)
+	if err != nil || !reused || again != conn {
+		t.Fatalf("an idle connection isn't reused: %v", err)
+	}
+
+	pool.Put(upstream, again, false)
+	conn, reused, err = pool.Get(upstream, 0)
+	if err != nil || reused {
+		t.Fatalf("a connection that isn't reusable is kept: %v", err)
+	}
+	pool.Put(upstream, conn, true)
+
+	other := testUpstream(t, addr)
+	other.Secure = true
+	if poolKey(other) == poolKey(upstream) {
+		t.Error("TLS and plain connections share a key")
+	}
+	for i := 0; i < 10 && atomic.LoadInt32(accepted) != 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := atomic.LoadInt32(accepted); n != 2 {
+		t.Errorf("%d connections are made, want 2", n)
+	}
+	if pool.stats != (PoolStats{Dialed: 2, Reused: 1}) {
+		t.Errorf("got stats %+v", pool.stats)
+	}
+}
+
+func TestPoolIdleTimeout(t *testing.T) {
+	storeSettings(&Settings{})
+	addr, _ := testOrigin(t)
+	upstream := testUpstream(t, addr)
+	pool := NewConnPool(2, 0, 0)
+	pool.IdleTimeout = 20 * time.Millisecond
+
+	conn, _, err := pool.Get(upstream, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.Put(upstream, conn, true)
+	time.Sleep(50 * time.Millisecond)
+	if _, reused, err := pool.Get(upstream, 0); err != nil || reused {
+		t.Errorf("an expired connection is reused: %v", err)
+	}
+	if pool.stats.Expired != 1 {
+		t.Errorf("got %d expired connections, want 1", pool.stats.Expired)
+	}
+}
+
+func TestPoolMaxConnsPerHost(t *testing.T) {
+	storeSettings(&Settings{})
+	addr, _ := testOrigin(t)
+	upstream := testUpstream(t, addr)
+	pool := NewConnPool(2, 1, 0)
+
+	conn, _, err := pool.Get(upstream, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, _, err := pool.Get(upstream, 50*time.Millisecond); err != errPoolWaitTimeout {
+		t.Errorf("got error %v, want %v", err, errPoolWaitTimeout)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("Get gave up after %s", elapsed)
+	}
+	if status := dialErrorStatus(errPoolWaitTimeout); status != protocol.StatusGatewayTimeout {
+		t.Errorf("got status %d for a wait timeout", status)
+	}
+
+	// A waiting Get takes the connection returned to the pool
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		pool.Put(upstream, conn, true)
+	}()
+	again, reused, err := pool.Get(upstream, 5*time.Second)
+	if err != nil || !reused || again != conn {
+		t.Errorf("the returned connection isn't passed to the waiting Get: %v", err)
+	}
+}
+
+func TestReplayable(t *testing.T) {
+	tests := []struct {
+		request string
+		want    bool
+	}{
+		{"GET / HTTP/1.1\r\n\r\n", true},
+		{"HEAD / HTTP/1.1\r\n\r\n", true},
+		{"DELETE / HTTP/1.1\r\n\r\n", true},
+		{"PUT / HTTP/1.1\r\nContent-Length: 0\r\n\r\n", true},
+		{"PUT / HTTP/1.1\r\nContent-Length: 2\r\n\r\nab", false},
+		{"GET / HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n0\r\n\r\n", false},
+		{"POST / HTTP/1.1\r\n\r\n", false},
+		{"PATCH / HTTP/1.1\r\n\r\n", false},
+	}
+	for _, test := range tests {
+		if got := replayable(readRequest(t, test.request)); got != test.want {
+			t.Errorf("replayable(%q) = %v, want %v", test.request, got, test.want)
+		}
+	}
+}
+
+// proxyRequest passes a request through handleClient and returns what the client receives
+func proxyRequest(t *testing.T, settings *Settings, data string) string {
+	conn := newBufferConn(data)
+	protocolErr, _ := handleClient(settings, protocol.NewConn(conn), "")
+	if protocolErr != nil {
+		return protocolErr.Error.Error()
+	}
+	return conn.written.String()
+}
+
+func TestRetryOnReusedConnection(t *testing.T) {
+	settings := loadTestSettings(t, map[string]interface{}{"AllowDestinations": []string{"127.0.0.0/8"}})
+	storeSettings(settings)
+	savedPool := upstreamPool
+	upstreamPool = NewConnPool(4, 0, 0)
+	defer func() { upstreamPool = savedPool }()
+	addr, accepted := testOrigin(t)
+
+	request := "GET http://" + addr + "/ HTTP/1.1\r\nHost: " + addr + "\r\n\r\n"
+	for i := 0; i < 2; i++ {
+		// The second request fails on the connection closed by the origin and is sent again
+		if response := proxyRequest(t, settings, request); !strings.HasSuffix(response, "\r\n\r\nok") {
+			t.Fatalf("request %d: got %q", i+1, response)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if n := atomic.LoadInt32(accepted); n != 2 {
+		t.Errorf("%d connections are made, want 2", n)
+	}
+	if upstreamPool.stats.Reused != 1 {
+		t.Errorf("got %d reused connections, want 1", upstreamPool.stats.Reused)
+	}
+
+	// The pool keeps the connection closed by the origin after the second response,
+	// and a request that isn't idempotent isn't sent again on a new one
+	request = "POST http://" + addr + "/ HTTP/1.1\r\nHost: " + addr + "\r\nContent-Length: 0\r\n\r\n"
+	if response := proxyRequest(t, settings, request); strings.HasSuffix(response, "\r\n\r\nok") {
+		t.Errorf("a POST request is retried: %q", response)
+	}
+	if n := atomic.LoadInt32(accepted); n != 2 {
+		t.Errorf("%d connections are made, want 2", n)
+	}
+}
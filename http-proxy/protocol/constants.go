@@ -1,25 +1,63 @@
 package protocol
 
-const MethodConnect = "CONNECT"
+const (
+	MethodConnect = "CONNECT"
+	MethodGet     = "GET"
+	MethodHead    = "HEAD"
+)
 
 const (
-	StatusOK = 200
+	StatusContinue           = 100
+	StatusSwitchingProtocols = 101
+	StatusEarlyHints         = 103
+
+	StatusOK        = 200
+	StatusNoContent = 204
+
+	StatusMovedPermanently  = 301
+	StatusFound             = 302
+	StatusNotModified       = 304
+	StatusTemporaryRedirect = 307
+	StatusPermanentRedirect = 308
 
 	StatusBadRequest = 400
 	StatusForbidden  = 403
 
+	StatusProxyAuthRequired = 407
+
+	StatusURITooLong           = 414
+	StatusHeaderFieldsTooLarge = 431
+
 	StatusNotImplemented = 501
 	StatusBadGateway     = 502
+	StatusGatewayTimeout = 504
 )
 
 var StatusText = map[int]string{
-	StatusOK: "OK",
+	StatusContinue:           "Continue",
+	StatusSwitchingProtocols: "Switching Protocols",
+	StatusEarlyHints:         "Early Hints",
+
+	StatusOK:        "OK",
+	StatusNoContent: "No Content",
+
+	StatusMovedPermanently:  "Moved Permanently",
+	StatusFound:             "Found",
+	StatusNotModified:       "Not Modified",
+	StatusTemporaryRedirect: "Temporary Redirect",
+	StatusPermanentRedirect: "Permanent Redirect",
 
 	StatusBadRequest: "Bad Request",
 	StatusForbidden:  "Forbidden",
 
+	StatusProxyAuthRequired: "Proxy Authentication Required",
+
+	StatusURITooLong:           "URI Too Long",
+	StatusHeaderFieldsTooLarge: "Request Header Fields Too Large",
+
 	StatusNotImplemented: "Not implemented",
 	StatusBadGateway:     "Bad Gateway",
+	StatusGatewayTimeout: "Gateway Timeout",
 }
 
 type Error struct {
@@ -1,28 +1,74 @@
 package protocol
 
 import (
+	"bufio"
+	"compress/flate"
 	"compress/gzip"
 	"compress/zlib"
+	"fmt"
+	"github.com/andybalholm/brotli"
 	"io"
 	"io/ioutil"
+	"strings"
 )
 
 const (
-	EncodingGzip = "gzip"
-	EncodingZlib = "zlib"
+	EncodingIdentity = "identity"
+	EncodingGzip     = "gzip"
+	EncodingDeflate  = "deflate"
+	EncodingBrotli   = "br"
+	EncodingZlib     = "zlib"
 )
 
-func (message *MessageBase) DecodedBodyReader() (io.ReadCloser, error) {
-	value, ok := message.Header("Content-Encoding")
-	if ok {
-		switch value {
-		case EncodingGzip:
-			return gzip.NewReader(message.Body.Reader)
-		case EncodingZlib:
-			return zlib.NewReader(message.Body.Reader)
-		}
+type ContentCoding struct {
+	NewReader func(io.Reader) (io.ReadCloser, error)
+	NewWriter func(io.Writer) io.WriteCloser
+}
+
+var contentCodings = make(map[string]ContentCoding)
+
+// RegisterContentCoding makes DecodedBodyReader and DecodedBodyWriter support the coding
+func RegisterContentCoding(name string, coding ContentCoding) {
+	contentCodings[strings.ToLower(name)] = coding
+}
+
+func init() {
+	identity := ContentCoding{
+		func(reader io.Reader) (io.ReadCloser, error) { return ioutil.NopCloser(reader), nil },
+		func(writer io.Writer) io.WriteCloser { return nopWriteCloser{writer} },
+	}
+	gzipCoding := ContentCoding{
+		func(reader io.Reader) (io.ReadCloser, error) { return gzip.NewReader(reader) },
+		func(writer io.Writer) io.WriteCloser { return gzip.NewWriter(writer) },
 	}
-	return ioutil.NopCloser(message.Body.Reader), nil
+	zlibCoding := ContentCoding{
+		func(reader io.Reader) (io.ReadCloser, error) { return zlib.NewReader(reader) },
+		func(writer io.Writer) io.WriteCloser { return zlib.NewWriter(writer) },
+	}
+
+	RegisterContentCoding(EncodingIdentity, identity)
+	RegisterContentCoding(EncodingGzip, gzipCoding)
+	RegisterContentCoding("x-gzip", gzipCoding)
+	RegisterContentCoding(EncodingZlib, zlibCoding)
+	RegisterContentCoding(EncodingDeflate, ContentCoding{newDeflateReader, zlibCoding.NewWriter})
+	RegisterContentCoding(EncodingBrotli, ContentCoding{
+		func(reader io.Reader) (io.ReadCloser, error) { return ioutil.NopCloser(brotli.NewReader(reader)), nil },
+		func(writer io.Writer) io.WriteCloser { return brotli.NewWriter(writer) },
+	})
+}
+
+// newDeflateReader accepts both zlib-wrapped data required by RFC 7230
+// and raw deflate data sent by some servers instead
+func newDeflateReader(reader io.Reader) (io.ReadCloser, error) {
+	buffered := bufio.NewReader(reader)
+	header, err := buffered.Peek(2)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if len(header) == 2 && header[0]&0x0f == 8 && (uint(header[0])<<8|uint(header[1]))%31 == 0 {
+		return zlib.NewReader(buffered)
+	}
+	return flate.NewReader(buffered), nil
 }
 
 type nopWriteCloser struct {
@@ -33,15 +79,116 @@ func (writer nopWriteCloser) Close() error {
 	return nil
 }
 
-func (message *MessageBase) DecodedBodyWriter() io.WriteCloser {
+// contentCodings returns the codings in the order they were applied to the body
+func (message *MessageBase) contentCodings() ([]ContentCoding, error) {
 	value, ok := message.Header("Content-Encoding")
-	if ok {
-		switch value {
-		case EncodingGzip:
-			return gzip.NewWriter(message.Body.Writer)
-		case EncodingZlib:
-			return zlib.NewWriter(message.Body.Writer)
+	if !ok {
+		return nil, nil
+	}
+	var codings []ContentCoding
+	for _, item := range strings.Split(value, ",") {
+		name := strings.ToLower(strings.TrimSpace(item))
+		if name == "" {
+			continue
+		}
+		coding, ok := contentCodings[name]
+		if !ok {
+			return nil, fmt.Errorf("unsupported content coding %s", name)
+		}
+		codings = append(codings, coding)
+	}
+	return codings, nil
+}
+
+// CanDecodeBody tells whether all content codings of the message are supported
+func (message *MessageBase) CanDecodeBody() bool {
+	_, err := message.contentCodings()
+	return err == nil
+}
+
+type readerChain []io.ReadCloser
+
+func (chain readerChain) Read(b []byte) (int, error) {
+	return chain[len(chain)-1].Read(b)
+}
+
+func (chain readerChain) Close() error {
+	var result error
+	for i := len(chain) - 1; i >= 0; i-- {
+		err := chain[i].Close()
+		if result == nil {
+			result = err
 		}
 	}
-	return nopWriteCloser{message.Body.Writer}
+	return result
+}
+
+func (message *MessageBase) DecodedBodyReader() (io.ReadCloser, error) {
+	codings, err := message.contentCodings()
+	if err != nil {
+		return nil, err
+	}
+
+	chain := readerChain{ioutil.NopCloser(message.Body.Reader)}
+	for i := len(codings) - 1; i >= 0; i-- {
+		reader, err := codings[i].NewReader(chain[len(chain)-1])
+		if err != nil {
+			chain.Close()
+			return nil, err
+		}
+		chain = append(chain, reader)
+	}
+	return chain, nil
+}
+
+type writerChain []io.WriteCloser
+
+func (chain writerChain) Write(b []byte) (int, error) {
+	return chain[0].Write(b)
+}
+
+func (chain writerChain) Close() error {
+	for _, writer := range chain {
+		err := writer.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DecodedBodyWriter encodes the data written to it with the content codings of the message.
+// It panics if some of the codings are unsupported, which can be checked with CanDecodeBody.
+func (message *MessageBase) DecodedBodyWriter() io.WriteCloser {
+	codings, err := message.contentCodings()
+	if err != nil {
+		panic(err)
+	}
+
+	chain := writerChain{nopWriteCloser{message.Body.Writer}}
+	for i := len(codings) - 1; i >= 0; i-- {
+		chain = append(writerChain{codings[i].NewWriter(chain[0])}, chain...)
+	}
+	return chain
+}
+
+// RestrictAcceptEncoding leaves only the content codings supported by DecodedBodyReader
+// in Accept-Encoding, so the response to the request can be rewritten.
+func (request *Request) RestrictAcceptEncoding() {
+	value, ok := request.Header("Accept-Encoding")
+	if !ok {
+		return
+	}
+	var accepted []string
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		name := strings.ToLower(strings.TrimSpace(strings.SplitN(item, ";", 2)[0]))
+		if _, ok := contentCodings[name]; ok {
+			accepted = append(accepted, item)
+		}
+	}
+	if accepted == nil {
+		accepted = []string{EncodingIdentity}
+	}
+	request.SetHeader("Accept-Encoding", strings.Join(accepted, ", "))
 }
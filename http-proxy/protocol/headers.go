@@ -0,0 +1,207 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"strings"
+	"sync/atomic"
+)
+
+// Limits of the start line and the headers of a message that apply unless SetHeaderLimits is called
+const (
+	DefaultMaxHeaderBytes = 64 * 1024
+	DefaultMaxHeaderCount = 100
+)
+
+var (
+	ErrURITooLong     = errors.New("request line is too long")
+	ErrHeaderTooLarge = errors.New("headers are too large")
+)
+
+// ReadErrorStatus chooses the status of the response to a request that can't be read
+func ReadErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrURITooLong):
+		return StatusURITooLong
+	case errors.Is(err, ErrHeaderTooLarge):
+		return StatusHeaderFieldsTooLarge
+	}
+	return StatusBadRequest
+}
+
+// HeaderLimits restrict the start line and the headers of messages read by ReadFrom
+type HeaderLimits struct {
+	MaxBytes int // of the start line and the headers together
+	MaxCount int
+}
+
+var headerLimits atomic.Value
+
+// SetHeaderLimits changes the limits of the messages read from now on. Zero limits are set to the defaults.
+func SetHeaderLimits(limits HeaderLimits) {
+	if limits.MaxBytes <= 0 {
+		limits.MaxBytes = DefaultMaxHeaderBytes
+	}
+	if limits.MaxCount <= 0 {
+		limits.MaxCount = DefaultMaxHeaderCount
+	}
+	headerLimits.Store(limits)
+}
+
+func currentHeaderLimits() HeaderLimits {
+	if limits, ok := headerLimits.Load().(HeaderLimits); ok {
+		return limits
+	}
+	return HeaderLimits{DefaultMaxHeaderBytes, DefaultMaxHeaderCount}
+}
+
+// headerReader reads the start line and the headers of a message within the limits
+type headerReader struct {
+	reader *bufio.Reader
+	limits HeaderLimits
+	size   int
+}
+
+func newHeaderReader(reader *bufio.Reader) *headerReader {
+	return &headerReader{reader: reader, limits: currentHeaderLimits()}
+}
+
+// readLine reads a line ending with LF or CRLF. An incomplete line is an error,
+// and tooLarge is returned if the line exceeds the size left.
+func (r *headerReader) readLine(tooLarge error) (string, error) {
+	var line []byte
+	for {
+		fragment, err := r.reader.ReadSlice('\n')
+		r.size += len(fragment)
+		if r.size > r.limits.MaxBytes {
+			return "", tooLarge
+		}
+		line = append(line, fragment...)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err == io.EOF && len(line) > 0 {
+			return "", io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return "", err
+		}
+		break
+	}
+	line = bytes.TrimSuffix(bytes.TrimSuffix(line, []byte("\n")), []byte("\r"))
+	return string(line), nil
+}
+
+func isTokenChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		strings.IndexByte("!#$%&'*+-.^_`|~", c) != -1
+}
+
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if !isTokenChar(name[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// validHeaderValue rejects control characters, which might be interpreted differently
+// by other parties, but allows obs-text
+func validHeaderValue(value string) bool {
+	for i := 0; i < len(value); i++ {
+		if c := value[i]; c < ' ' && c != '\t' || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// ValidHeader checks a header field that doesn't come from a parsed message, such as one from the config
+func ValidHeader(name, value string) bool {
+	return validHeaderName(name) && validHeaderValue(value)
+}
+
+// readHeadersFrom reads header fields as described in RFC 7230, section 3.2. Names are
+// canonicalized, and obs-fold is replaced with a space. Whitespace before the colon is an error
+// in a request, but it's removed from a response (section 3.2.4).
+func (message *MessageBase) readHeadersFrom(r *headerReader, isRequest bool) error {
+	for {
+		line, err := r.readLine(ErrHeaderTooLarge)
+		if err != nil {
+			return fmt.Errorf("failed to read a header: %w", err)
+		}
+		if line == "" {
+			return nil
+		}
+
+		if line[0] == ' ' || line[0] == '\t' {
+			if len(message.Headers) == 0 {
+				return errors.New("first header starts with whitespace")
+			}
+			value := strings.Trim(line, " \t")
+			if !validHeaderValue(value) {
+				return fmt.Errorf(`invalid header line "%s"`, line)
+			}
+			last := &message.Headers[len(message.Headers)-1]
+			last.Value = strings.Trim(last.Value+" "+value, " ")
+			continue
+		}
+
+		if len(message.Headers) >= r.limits.MaxCount {
+			return fmt.Errorf("more than %d headers: %w", r.limits.MaxCount, ErrHeaderTooLarge)
+		}
+		colon := strings.IndexByte(line, ':')
+		if colon == -1 {
+			return fmt.Errorf(`invalid header line "%s"`, line)
+		}
+		name := line[:colon]
+		if trimmed := strings.TrimRight(name, " \t"); trimmed != name {
+			if isRequest {
+				return fmt.Errorf(`whitespace before the colon in header line "%s"`, line)
+			}
+			name = trimmed
+		}
+		value := strings.Trim(line[colon+1:], " \t")
+		if !validHeaderName(name) || !validHeaderValue(value) {
+			return fmt.Errorf(`invalid header line "%s"`, line)
+		}
+		message.Headers = append(message.Headers, Header{textproto.CanonicalMIMEHeaderKey(name), value})
+	}
+}
+
+// Fields that must not be sent as trailers, since they control the framing, routing, caching,
+// authentication or processing of the message (RFC 7230, section 4.1.2)
+var forbiddenTrailers = []string{
+	"Transfer-Encoding", "Content-Length", "Trailer", "Connection", "Keep-Alive", "Proxy-Connection",
+	"Upgrade", "TE", "Host", "Cache-Control", "Expect", "Max-Forwards", "Pragma", "Range",
+	"If-Match", "If-None-Match", "If-Modified-Since", "If-Unmodified-Since", "If-Range",
+	"Authorization", "Proxy-Authorization", "WWW-Authenticate", "Proxy-Authenticate",
+	"Cookie", "Set-Cookie", "Age", "Date", "Expires", "Location", "Retry-After", "Vary", "Warning",
+	"Content-Encoding", "Content-Type", "Content-Range",
+}
+
+// AllowedTrailers leaves the trailers that may be forwarded or merged into the headers
+func AllowedTrailers(trailers []Header) []Header {
+	var result []Header
+	for _, trailer := range trailers {
+		allowed := true
+		for _, key := range forbiddenTrailers {
+			if strings.EqualFold(trailer.Key, key) {
+				allowed = false
+				break
+			}
+		}
+		if allowed {
+			result = append(result, trailer)
+		}
+	}
+	return result
+}
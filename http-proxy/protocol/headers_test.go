@@ -0,0 +1,205 @@
+package protocol
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func init() {
+	// ReadFrom logs every start line
+	log.SetOutput(ioutil.Discard)
+}
+
+// bufferConn is a connection that reads the given data and keeps what is written
+type bufferConn struct {
+	net.Conn
+	reader  io.Reader
+	written bytes.Buffer
+}
+
+func newBufferConn(data []byte) *bufferConn {
+	return &bufferConn{reader: bytes.NewReader(data)}
+}
+
+func (conn *bufferConn) Read(b []byte) (int, error) {
+	return conn.reader.Read(b)
+}
+
+func (conn *bufferConn) Write(b []byte) (int, error) {
+	return conn.written.Write(b)
+}
+
+func (conn *bufferConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}
+}
+
+func readHeaders(input string, isRequest bool) ([]Header, error) {
+	var message MessageBase
+	err := message.readHeadersFrom(newHeaderReader(bufio.NewReader(strings.NewReader(input))), isRequest)
+	return message.Headers, err
+}
+
+func TestReadHeaders(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		isRequest bool
+		want      []Header
+		wantErr   bool
+	}{
+		{"canonical names", "content-length: 0\r\nX-FORWARDED-FOR: a\r\n\r\n", true,
+			[]Header{{"Content-Length", "0"}, {"X-Forwarded-For", "a"}}, false},
+		{"no space after the colon", "Host:example.com\r\n\r\n", true, []Header{{"Host", "example.com"}}, false},
+		{"bare LF", "Host: example.com\n\n", true, []Header{{"Host", "example.com"}}, false},
+		{"surrounding whitespace", "X-A: \t value \t\r\n\r\n", true, []Header{{"X-A", "value"}}, false},
+		{"empty value", "X-A:\r\n\r\n", true, []Header{{"X-A", ""}}, false},
+		{"obs-fold", "X-A: one\r\n two\r\n\tthree \r\nX-B: b\r\n\r\n", true,
+			[]Header{{"X-A", "one two three"}, {"X-B", "b"}}, false},
+		{"obs-fold of an empty value", "X-A:\r\n two\r\n\r\n", false, []Header{{"X-A", "two"}}, false},
+		{"obs-fold before the first header", " X-A: a\r\n\r\n", true, nil, true},
+		{"whitespace before the colon in a request", "Host : example.com\r\n\r\n", true, nil, true},
+		{"whitespace before the colon in a response", "Server\t : test\r\n\r\n", false,
+			[]Header{{"Server", "test"}}, false},
+		{"no colon", "Host example.com\r\n\r\n", true, nil, true},
+		{"empty name", ": value\r\n\r\n", false, nil, true},
+		{"separator in the name", "X(A): a\r\n\r\n", true, nil, true},
+		{"control character in the value", "X-A: a\x00b\r\n\r\n", false, nil, true},
+		{"CR in the value", "X-A: a\rb\r\n\r\n", true, nil, true},
+		{"obs-text in the value", "X-A: caf\xc3\xa9\r\n\r\n", true, []Header{{"X-A", "caf\xc3\xa9"}}, false},
+		{"incomplete line", "Host: example.com", true, nil, true},
+		{"no empty line", "Host: example.com\r\n", true, nil, true},
+	}
+	for _, test := range tests {
+		headers, err := readHeaders(test.input, test.isRequest)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: got error %v, want error %v", test.name, err, test.wantErr)
+			continue
+		}
+		if !test.wantErr && !reflect.DeepEqual(headers, test.want) {
+			t.Errorf("%s: got %q, want %q", test.name, headers, test.want)
+		}
+	}
+}
+
+func TestHeaderLimits(t *testing.T) {
+	SetHeaderLimits(HeaderLimits{MaxBytes: 256, MaxCount: 4})
+	defer SetHeaderLimits(HeaderLimits{})
+
+	tests := []struct {
+		name       string
+		input      string
+		isRequest  bool
+		wantErr    error
+		wantStatus int
+	}{
+		{"request within the limits", "GET / HTTP/1.1\r\nHost: a\r\n\r\n", true, nil, 0},
+		{"long request line", "GET /" + strings.Repeat("a", 300) + " HTTP/1.1\r\n\r\n", true,
+			ErrURITooLong, StatusURITooLong},
+		{"request line without an end", "GET /" + strings.Repeat("a", 300), true,
+			ErrURITooLong, StatusURITooLong},
+		{"large request header", "GET / HTTP/1.1\r\nX-A: " + strings.Repeat("a", 300) + "\r\n\r\n", true,
+			ErrHeaderTooLarge, StatusHeaderFieldsTooLarge},
+		{"headers over the byte limit together", "GET / HTTP/1.1\r\n" +
+			strings.Repeat("X-A: "+strings.Repeat("a", 70)+"\r\n", 4) + "\r\n", true,
+			ErrHeaderTooLarge, StatusHeaderFieldsTooLarge},
+		{"too many request headers", "GET / HTTP/1.1\r\n" + strings.Repeat("X-A: a\r\n", 5) + "\r\n", true,
+			ErrHeaderTooLarge, StatusHeaderFieldsTooLarge},
+		{"folded lines don't count as headers", "GET / HTTP/1.1\r\n" +
+			strings.Repeat("X-A: a\r\n b\r\n", 4) + "\r\n", true, nil, 0},
+		{"response within the limits", "HTTP/1.1 204 No Content\r\nServer: a\r\n\r\n", false, nil, 0},
+		{"long status line", "HTTP/1.1 200 " + strings.Repeat("a", 300) + "\r\n\r\n", false,
+			ErrHeaderTooLarge, StatusHeaderFieldsTooLarge},
+		{"too many response headers", "HTTP/1.1 204 No Content\r\n" + strings.Repeat("X-A: a\r\n", 5) + "\r\n",
+			false, ErrHeaderTooLarge, StatusHeaderFieldsTooLarge},
+	}
+	for _, test := range tests {
+		conn := newBufferConn([]byte(test.input))
+		var err error
+		if test.isRequest {
+			err = new(Request).ReadFrom(conn)
+		} else {
+			err = new(Response).ReadFrom(conn, MethodGet)
+		}
+		if test.wantErr == nil {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", test.name, err)
+			}
+			continue
+		}
+		if !errors.Is(err, test.wantErr) {
+			t.Errorf("%s: got error %v, want %v", test.name, err, test.wantErr)
+		}
+		if status := ReadErrorStatus(err); status != test.wantStatus {
+			t.Errorf("%s: got status %d, want %d", test.name, status, test.wantStatus)
+		}
+	}
+}
+
+func TestReadErrorStatusOfOtherErrors(t *testing.T) {
+	err := new(Request).ReadFrom(newBufferConn([]byte("GET / HTTP/1.1\r\nHost : a\r\n\r\n")))
+	if err == nil {
+		t.Fatal("whitespace before the colon is accepted")
+	}
+	if status := ReadErrorStatus(err); status != StatusBadRequest {
+		t.Errorf("got status %d, want %d", status, StatusBadRequest)
+	}
+}
+
+// checkParsedHeaders verifies that the headers are valid and read back unchanged once written
+func checkParsedHeaders(t *testing.T, headers []Header, isRequest bool) {
+	for _, header := range headers {
+		if !validHeaderName(header.Key) || !validHeaderValue(header.Value) {
+			t.Fatalf("invalid header %q accepted", header)
+		}
+		if strings.Trim(header.Value, " \t") != header.Value {
+			t.Fatalf("value of %q isn't trimmed", header)
+		}
+	}
+
+	var buffer bytes.Buffer
+	message := MessageBase{Headers: headers}
+	if err := message.writeHeadersTo(&buffer); err != nil {
+		t.Fatal(err)
+	}
+	var reread MessageBase
+	// The written lines may be longer than the original ones
+	reader := &headerReader{reader: bufio.NewReader(&buffer), limits: HeaderLimits{1 << 30, 1 << 30}}
+	if err := reread.readHeadersFrom(reader, isRequest); err != nil {
+		t.Fatalf("written headers can't be read: %v", err)
+	}
+	if len(headers) != len(reread.Headers) || len(headers) > 0 && !reflect.DeepEqual(headers, reread.Headers) {
+		t.Fatalf("headers changed after a round trip: %q, then %q", headers, reread.Headers)
+	}
+}
+
+func FuzzRequestReadFrom(f *testing.F) {
+	f.Fuzz(func(t *testing.T, data []byte) {
+		request := new(Request)
+		if err := request.ReadFrom(newBufferConn(data)); err != nil {
+			return
+		}
+		checkParsedHeaders(t, request.Headers, true)
+		request.DiscardBody()
+		checkParsedHeaders(t, request.Trailers(), true)
+	})
+}
+
+func FuzzResponseReadFrom(f *testing.F) {
+	f.Fuzz(func(t *testing.T, data []byte) {
+		response := new(Response)
+		if err := response.ReadFrom(newBufferConn(data), MethodGet); err != nil {
+			return
+		}
+		checkParsedHeaders(t, response.Headers, false)
+		response.DiscardBody()
+		checkParsedHeaders(t, response.Trailers(), false)
+	})
+}
@@ -27,9 +27,58 @@ func NewPipe() *Pipe {
 	return &Pipe{r, w}
 }
 
+// Conn is a connection with a read buffer that persists between messages,
+// so several requests or responses can be read from it one after another.
+type Conn struct {
+	net.Conn
+	Reader *bufio.Reader
+}
+
+func NewConn(conn net.Conn) *Conn {
+	if c, ok := conn.(*Conn); ok {
+		return c
+	}
+	return &Conn{conn, bufio.NewReader(conn)}
+}
+
+func (conn *Conn) Read(b []byte) (int, error) {
+	return conn.Reader.Read(b)
+}
+
+func (conn *Conn) CloseRead() error {
+	if c, ok := conn.Conn.(interface {
+		CloseRead() error
+	}); ok {
+		return c.CloseRead()
+	}
+	return nil
+}
+
+func (conn *Conn) CloseWrite() error {
+	if c, ok := conn.Conn.(interface {
+		CloseWrite() error
+	}); ok {
+		return c.CloseWrite()
+	}
+	return nil
+}
+
 type MessageBase struct {
 	Headers []Header
 	Body    *Pipe
+
+	// KeepAlive makes WriteTo announce a persistent connection instead of "Connection: close"
+	KeepAlive bool
+
+	// Upgrade makes WriteTo pass the Upgrade header and announce "Connection: upgrade"
+	Upgrade bool
+
+	// lengthUnknown makes WriteTo buffer a non-chunked body to calculate its Content-Length
+	lengthUnknown bool
+
+	bodyDone chan struct{}
+	bodyErr  error
+	trailers []Header // received after a chunked body, valid once bodyDone is closed
 }
 
 func (message *MessageBase) Header(key string) (string, bool) {
@@ -60,9 +109,97 @@ func (message *MessageBase) SetHeader(key, value string) {
 	message.Headers = append(message.Headers, Header{key, value})
 }
 
-func (message *MessageBase) Chunked() bool {
+// AddHeader adds a header even if there are other headers with the same key
+func (message *MessageBase) AddHeader(key, value string) {
+	message.Headers = append(message.Headers, Header{key, value})
+}
+
+func (message *MessageBase) connectionOptions() []string {
+	value, ok := message.Header("Connection")
+	if proxyValue, proxyOk := message.Header("Proxy-Connection"); proxyOk {
+		// Non-standard, but still sent by clients configured to use a proxy
+		value += ", " + proxyValue
+		ok = true
+	}
+	if !ok {
+		return nil
+	}
+	var options []string
+	for _, item := range strings.Split(value, ",") {
+		item = strings.ToLower(strings.TrimSpace(item))
+		if item != "" {
+			options = append(options, item)
+		}
+	}
+	return options
+}
+
+func (message *MessageBase) hasConnectionOption(option string) bool {
+	for _, item := range message.connectionOptions() {
+		if item == option {
+			return true
+		}
+	}
+	return false
+}
+
+// persistent tells whether the sender of a message of the given protocol version
+// wants to reuse the connection afterwards (RFC 7230, section 6.3).
+func (message *MessageBase) persistent(protocol string) bool {
+	if message.hasConnectionOption("close") {
+		return false
+	}
+	if protocol == "HTTP/1.0" {
+		return message.hasConnectionOption("keep-alive")
+	}
+	return strings.HasPrefix(protocol, "HTTP/1.")
+}
+
+// UpgradeProtocols returns the protocols listed in the Upgrade header
+// if the sender asks to switch to one of them (RFC 7230, section 6.7).
+func (message *MessageBase) UpgradeProtocols() []string {
+	value, ok := message.Header("Upgrade")
+	if !ok || !message.hasConnectionOption("upgrade") {
+		return nil
+	}
+	var protocols []string
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			protocols = append(protocols, item)
+		}
+	}
+	return protocols
+}
+
+func (message *MessageBase) transferCodings() []string {
 	value, ok := message.Header("Transfer-Encoding")
-	return ok && strings.EqualFold(value, "chunked")
+	if !ok {
+		return nil
+	}
+	var codings []string
+	for _, item := range strings.Split(value, ",") {
+		item = strings.ToLower(strings.TrimSpace(item))
+		if item != "" {
+			codings = append(codings, item)
+		}
+	}
+	return codings
+}
+
+// Chunked tells whether chunked is the final transfer coding of the message
+func (message *MessageBase) Chunked() bool {
+	codings := message.transferCodings()
+	return len(codings) > 0 && codings[len(codings)-1] == "chunked"
+}
+
+// Delimited tells whether the end of the body can be found without closing the connection.
+func (message *MessageBase) Delimited() bool {
+	if message.Body == nil || message.Chunked() {
+		return true
+	}
+	_, ok := message.Header("Content-Length")
+	return ok
 }
 
 func (message *MessageBase) SetChunked(value bool) {
@@ -72,9 +209,36 @@ func (message *MessageBase) SetChunked(value bool) {
 	} else {
 		message.DeleteHeader("Transfer-Encoding")
 		message.SetHeader("Content-Length", "0") // WriteTo will recalculate it
+		message.lengthUnknown = true
 	}
 }
 
+// SetDelimitedByClose removes the chunked transfer coding, so the body ends when the connection
+// is closed. HTTP/1.0 recipients don't understand chunks (RFC 7230, section 3.3.1).
+// The headers are sent before the body is read, so trailers can't be merged into them
+// and are dropped. They may only carry metadata that is safe to discard anyway.
+func (message *MessageBase) SetDelimitedByClose() {
+	codings := message.transferCodings()
+	if len(codings) > 0 && codings[len(codings)-1] == "chunked" {
+		codings = codings[:len(codings)-1]
+	}
+	if len(codings) > 0 {
+		message.SetHeader("Transfer-Encoding", strings.Join(codings, ", "))
+	} else {
+		message.DeleteHeader("Transfer-Encoding")
+	}
+	message.DeleteHeader("Content-Length")
+	message.DeleteHeader("Trailer")
+	message.lengthUnknown = false
+}
+
+// SetContentLength declares the length of a rewritten body, so WriteTo can stream it without buffering.
+func (message *MessageBase) SetContentLength(length int64) {
+	message.DeleteHeader("Transfer-Encoding")
+	message.SetHeader("Content-Length", strconv.FormatInt(length, 10))
+	message.lengthUnknown = false
+}
+
 func filterHeader(headers []Header, key string) []Header {
 	result := make([]Header, 0, len(headers))
 	for _, header := range headers {
@@ -89,14 +253,19 @@ func (message *MessageBase) DeleteHeader(key string) {
 	message.Headers = filterHeader(message.Headers, key)
 }
 
-func (message *MessageBase) readChunkFrom(reader io.Reader, length int) error {
-	_, err := io.CopyN(message.Body.Writer, reader, int64(length))
+func readChunkFrom(writer io.Writer, reader io.Reader, length int64) error {
+	_, err := io.CopyN(writer, reader, length)
+	return err
+}
+
+func readUntilCloseFrom(writer io.Writer, reader io.Reader) error {
+	_, err := io.Copy(writer, reader)
 	return err
 }
 
 func ReadLine(reader *bufio.Reader) (string, error) {
 	line, isPrefix, err := reader.ReadLine()
-	if isPrefix && err != nil {
+	if isPrefix && err == nil {
 		err = errors.New("line is too long")
 	}
 	return string(line), err
@@ -107,23 +276,123 @@ func WriteLine(writer io.Writer, line string) error {
 	return err
 }
 
-func (message *MessageBase) readChunkedBodyFrom(reader *bufio.Reader) error {
+// Chunks are passed through the Body pipe in writes of at most this size, and writeChunkedBodyTo
+// reads with a buffer of the same size, so smaller chunks keep their boundaries
+const chunkBufferSize = 64 * 1024
+
+// validChunkExtensions checks the syntax of chunk extensions, which are then ignored
+// (RFC 7230, section 4.1.1). Whitespace around the separators is allowed as BWS.
+func validChunkExtensions(extensions string) bool {
+	i := 0
+	skipWhitespace := func() {
+		for i < len(extensions) && (extensions[i] == ' ' || extensions[i] == '\t') {
+			i++
+		}
+	}
+	skipToken := func() bool {
+		start := i
+		for i < len(extensions) && isTokenChar(extensions[i]) {
+			i++
+		}
+		return i > start
+	}
+	skipQuotedString := func() bool {
+		for i++; i < len(extensions); i++ {
+			switch c := extensions[i]; {
+			case c == '"':
+				i++
+				return true
+			case c == '\\':
+				i++
+				if i == len(extensions) || !validHeaderValue(extensions[i:i+1]) {
+					return false
+				}
+			case !validHeaderValue(extensions[i : i+1]):
+				return false
+			}
+		}
+		return false
+	}
+
+	for i < len(extensions) {
+		if extensions[i] != ';' {
+			return false
+		}
+		i++
+		skipWhitespace()
+		if !skipToken() {
+			return false
+		}
+		skipWhitespace()
+		if i < len(extensions) && extensions[i] == '=' {
+			i++
+			skipWhitespace()
+			if i < len(extensions) && extensions[i] == '"' {
+				if !skipQuotedString() {
+					return false
+				}
+			} else if !skipToken() {
+				return false
+			}
+			skipWhitespace()
+		}
+	}
+	return true
+}
+
+func parseChunkLength(line string) (uint64, error) {
+	length := line
+	if i := strings.IndexByte(line, ';'); i != -1 {
+		if !validChunkExtensions(line[i:]) {
+			return 0, fmt.Errorf("invalid chunk extensions %s", line)
+		}
+		length = strings.TrimRight(line[:i], " \t")
+	}
+	value, err := strconv.ParseUint(length, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("can't parse chunk length %s", line)
+	}
+	return value, nil
+}
+
+// copyChunkFrom passes chunk data to the writer in writes of at most the buffer size
+func copyChunkFrom(writer io.Writer, reader io.Reader, length uint64, buf []byte) error {
+	for length > 0 {
+		n := len(buf)
+		if uint64(n) > length {
+			n = int(length)
+		}
+		_, err := io.ReadFull(reader, buf[:n])
+		if err != nil {
+			return err
+		}
+		_, err = writer.Write(buf[:n])
+		if err != nil {
+			return err
+		}
+		length -= uint64(n)
+	}
+	return nil
+}
+
+// readChunkedBodyFrom reads the chunks to the writer and keeps the trailers of the message
+func (message *MessageBase) readChunkedBodyFrom(writer io.Writer, reader *bufio.Reader, isRequest bool) error {
+	buf := make([]byte, chunkBufferSize)
 	for {
 		line, err := ReadLine(reader)
 		if err != nil {
 			return errors.New("failed to read chunk length: " + err.Error())
 		}
 
-		length, err := strconv.ParseUint(line, 16, 32)
+		length, err := parseChunkLength(line)
 		if err != nil {
-			// TODO: Maybe implement chunk extension options
-			return fmt.Errorf("can't parse chunk length %s", line)
+			return err
 		}
 		if length == 0 {
 			break
 		}
 
-		err = message.readChunkFrom(reader, int(length))
+		err = copyChunkFrom(writer, reader, length, buf)
 		if err != nil {
 			return errors.New("failed to read chunk data: " + err.Error())
 		}
@@ -135,73 +404,170 @@ func (message *MessageBase) readChunkedBodyFrom(reader *bufio.Reader) error {
 			return errors.New("chunk has more data than expected")
 		}
 	}
-	for {
-		line, err := ReadLine(reader)
-		if err != nil {
-			return errors.New("failed to read a trailer: " + err.Error())
-		}
-		if line == "" {
-			break
-		}
+	var trailers MessageBase
+	err := trailers.readHeadersFrom(newHeaderReader(reader), isRequest)
+	if err != nil {
+		return fmt.Errorf("failed to read trailers: %w", err)
 	}
+	message.trailers = trailers.Headers
 	return nil
 }
 
-func (message *MessageBase) ReadFrom(reader *bufio.Reader) error {
-	for {
-		line, err := ReadLine(reader)
-		if err != nil {
-			return errors.New("failed to read a header: " + err.Error())
+// Special values of a body length returned by bodyLength
+const (
+	lengthChunked    = -1
+	lengthUntilClose = -2
+)
+
+func (message *MessageBase) contentLength() (int64, bool, error) {
+	value, ok := message.Header("Content-Length")
+	if !ok {
+		return 0, false, nil
+	}
+	// Repeated headers are allowed if they have the same value (RFC 7230, section 3.3.2)
+	var length int64 = -1
+	for _, item := range strings.Split(value, ",") {
+		itemLength, err := strconv.ParseInt(strings.TrimSpace(item), 10, 64)
+		if err != nil || itemLength < 0 {
+			return 0, false, fmt.Errorf("invalid Content-Length %s", value)
 		}
-		if line == "" {
-			break
+		if length != -1 && itemLength != length {
+			return 0, false, fmt.Errorf("conflicting Content-Length values %s", value)
 		}
+		length = itemLength
+	}
+	return length, true, nil
+}
 
-		parts := strings.Split(line, ": ")
-		if len(parts) != 2 {
-			return errors.New(fmt.Sprintf(`invalid header line "%s"`, line))
+// bodyLength finds out how the body of a message is delimited (RFC 7230, section 3.3.3)
+// provided that the message has a body at all.
+func (message *MessageBase) bodyLength(isRequest bool) (int64, error) {
+	length, hasLength, err := message.contentLength()
+	if err != nil {
+		return 0, err
+	}
+
+	if codings := message.transferCodings(); codings != nil {
+		// A message with both headers might be interpreted differently
+		// by another party, which allows request smuggling
+		if hasLength {
+			return 0, errors.New("message has both Transfer-Encoding and Content-Length")
+		}
+		if message.Chunked() {
+			return lengthChunked, nil
 		}
-		message.Headers = append(message.Headers, Header{parts[0], parts[1]})
+		if isRequest {
+			return 0, errors.New("final transfer coding of a request isn't chunked")
+		}
+		return lengthUntilClose, nil
 	}
-	message.Body = NewPipe()
 
-	if message.Chunked() {
-		go func() { message.Body.Writer.CloseWithError(message.readChunkedBodyFrom(reader)) }()
+	if hasLength {
+		// Repeated values become one, so writeBodyTo can parse the header again
+		message.SetHeader("Content-Length", strconv.FormatInt(length, 10))
+		return length, nil
+	}
+	if isRequest {
+		return 0, nil
+	}
+	return lengthUntilClose, nil
+}
+
+// readBodyFrom starts reading a body of the given length to the Body pipe.
+// Messages without a body (even an empty one) get a nil Body.
+func (message *MessageBase) readBodyFrom(reader *bufio.Reader, length int64, isRequest bool) {
+	if length == 0 {
+		message.Body = nil
+		return
+	}
+	// Body may be replaced with a rewritten one while the original is still being read
+	body := NewPipe()
+	message.Body = body
+	message.bodyDone = make(chan struct{})
+
+	switch length {
+	case lengthChunked:
+		go func() { message.finishBody(body, message.readChunkedBodyFrom(body.Writer, reader, isRequest)) }()
+	case lengthUntilClose:
+		go func() { message.finishBody(body, readUntilCloseFrom(body.Writer, reader)) }()
+	default:
+		go func() { message.finishBody(body, readChunkFrom(body.Writer, reader, length)) }()
+	}
+}
+
+// finishBody closes the pipe last, so the trailers are available to whoever reads the body to the end
+func (message *MessageBase) finishBody(body *Pipe, err error) {
+	message.bodyErr = err
+	close(message.bodyDone)
+	body.Writer.CloseWithError(err)
+}
+
+// Trailers returns the trailer fields received after a chunked body. They are only available
+// after the body has been read to the end, and nil is returned before that.
+func (message *MessageBase) Trailers() []Header {
+	if message.bodyDone == nil {
+		return nil
+	}
+	select {
+	case <-message.bodyDone:
+		return message.trailers
+	default:
 		return nil
 	}
+}
 
-	length := 0
-	value, ok := message.Header("Content-Length")
-	if ok {
-		var err error
-		length, err = strconv.Atoi(value)
-		if err != nil {
-			return errors.New("can't convert Content-Length to integer: " + err.Error())
-		}
+// mergeTrailers moves the trailers to the headers when the body isn't sent chunked
+func (message *MessageBase) mergeTrailers() {
+	message.DeleteHeader("Trailer")
+	message.Headers = append(message.Headers, AllowedTrailers(message.Trailers())...)
+}
+
+// DiscardBody skips the unread part of a body received by ReadFrom and waits until
+// the body is consumed from the connection, so the next message can be read from it.
+func (message *MessageBase) DiscardBody() error {
+	if message.bodyDone == nil {
+		return nil
 	}
-	go func() { message.Body.Writer.CloseWithError(message.readChunkFrom(reader, length)) }()
-	return nil
+	_, err := io.Copy(ioutil.Discard, message.Body.Reader)
+	<-message.bodyDone
+	if message.bodyErr != nil {
+		return message.bodyErr
+	}
+	return err
 }
 
-func (message *MessageBase) setHopByHopHeaders() {
-	if value, ok := message.Header("Connection"); ok {
-		for _, item := range strings.Split(value, ", ") {
-			if item != "close" {
-				message.DeleteHeader(item)
-			}
+// deleteHopByHopHeaders deletes the headers that apply to a single connection,
+// except for Connection itself
+func (message *MessageBase) deleteHopByHopHeaders() {
+	for _, item := range message.connectionOptions() {
+		if item != "close" && item != "keep-alive" && !(item == "upgrade" && message.Upgrade) {
+			message.DeleteHeader(item)
 		}
 	}
-	message.SetHeader("Connection", "close")
-
-	message.DeleteHeader("Upgrade")
+	message.DeleteHeader("Proxy-Connection")
+	message.DeleteHeader("Keep-Alive")
+	if !message.Upgrade {
+		message.DeleteHeader("Upgrade")
+	}
+}
 
-	// FIXME: Maybe support Trailer
+func (message *MessageBase) setHopByHopHeaders() {
+	message.deleteHopByHopHeaders()
+	switch {
+	case message.Upgrade:
+		message.SetHeader("Connection", "upgrade")
+	case message.KeepAlive:
+		message.SetHeader("Connection", "keep-alive")
+	default:
+		message.SetHeader("Connection", "close")
+	}
 }
 
+// writeChunkedBodyTo sends every read from the body as a chunk, followed by the trailers
 func (message *MessageBase) writeChunkedBodyTo(writer io.Writer) error {
 	if message.Body != nil {
+		buf := make([]byte, chunkBufferSize)
 		for {
-			buf := make([]byte, 4*1024*1024)
 			n, err := message.Body.Reader.Read(buf)
 			if n > 0 {
 				err := WriteLine(writer, strconv.FormatUint(uint64(n), 16))
@@ -229,13 +595,35 @@ func (message *MessageBase) writeChunkedBodyTo(writer io.Writer) error {
 	if err != nil {
 		return err
 	}
-	// FIXME: we may send here trailing headers
-	return WriteLine(writer, "")
+	trailers := MessageBase{Headers: AllowedTrailers(message.Trailers())}
+	return trailers.writeHeadersTo(writer)
+}
+
+func (message *MessageBase) writeBodyTo(writer io.Writer) error {
+	if message.Body == nil {
+		return nil
+	}
+	value, ok := message.Header("Content-Length")
+	if !ok {
+		// The body is delimited by closing the connection
+		_, err := io.Copy(writer, message.Body.Reader)
+		return err
+	}
+	length, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return errors.New("can't convert Content-Length to integer: " + err.Error())
+	}
+	_, err = io.CopyN(writer, message.Body.Reader, length)
+	if err == io.EOF {
+		return errors.New("body is shorter than Content-Length")
+	}
+	return err
 }
 
 func (message *MessageBase) WriteTo(writer io.Writer) error {
 	var body []byte
-	if !message.Chunked() {
+	chunked := message.Chunked()
+	if !chunked && message.lengthUnknown {
 		if message.Body != nil {
 			var err error
 			body, err = ioutil.ReadAll(message.Body.Reader)
@@ -243,28 +631,42 @@ func (message *MessageBase) WriteTo(writer io.Writer) error {
 				return err
 			}
 		}
-		if _, ok := message.Header("Content-Length"); ok {
-			message.SetHeader("Content-Length", strconv.Itoa(len(body)))
-		}
+		message.SetHeader("Content-Length", strconv.Itoa(len(body)))
+		message.mergeTrailers()
 	}
 	message.setHopByHopHeaders()
 
+	err := message.writeHeadersTo(writer)
+	if err != nil {
+		return err
+	}
+	if message.lengthUnknown && !chunked {
+		_, err := writer.Write(body)
+		return err
+	}
+	return message.writeStreamedBodyTo(writer)
+}
+
+func (message *MessageBase) writeHeadersTo(writer io.Writer) error {
 	for _, header := range message.Headers {
 		err := WriteLine(writer, header.Key+": "+header.Value)
 		if err != nil {
 			return err
 		}
 	}
-	err := WriteLine(writer, "")
-	if err != nil {
-		return err
-	}
+	return WriteLine(writer, "")
+}
 
-	if !message.Chunked() {
-		_, err := writer.Write(body)
-		return err
+// writeStreamedBodyTo writes a body whose length is either declared or delimited by chunks
+func (message *MessageBase) writeStreamedBodyTo(writer io.Writer) error {
+	if message.Body == nil {
+		// Responses to HEAD, 204 and 304 may describe a chunked body without having one
+		return nil
+	}
+	if message.Chunked() {
+		return message.writeChunkedBodyTo(writer)
 	}
-	return message.writeChunkedBodyTo(writer)
+	return message.writeBodyTo(writer)
 }
 
 func logMessage(conn net.Conn, write bool, startLine string) {
@@ -283,9 +685,10 @@ type Request struct {
 var requestLineExp = regexp.MustCompile(`^(\w+) (.+) (HTTP/\S+)$`)
 
 func (request *Request) ReadFrom(conn net.Conn) error {
-	reader := bufio.NewReader(conn)
+	reader := NewConn(conn).Reader
+	headers := newHeaderReader(reader)
 
-	line, err := ReadLine(reader)
+	line, err := headers.readLine(ErrURITooLong)
 	if err != nil {
 		return err
 	}
@@ -299,7 +702,28 @@ func (request *Request) ReadFrom(conn net.Conn) error {
 	request.Url = match[2]
 	request.Protocol = match[3]
 
-	return request.MessageBase.ReadFrom(reader)
+	err = request.readHeadersFrom(headers, true)
+	if err != nil {
+		return err
+	}
+	length, err := request.bodyLength(true)
+	if err != nil {
+		return err
+	}
+	request.readBodyFrom(reader, length, true)
+	return nil
+}
+
+// Persistent tells whether the client wants to send more requests on the same connection.
+func (request *Request) Persistent() bool {
+	return request.persistent(request.Protocol)
+}
+
+// ExpectsContinue tells whether the client waits for a 100 (Continue) response
+// before sending the body (RFC 7231, section 5.1.1).
+func (request *Request) ExpectsContinue() bool {
+	value, ok := request.Header("Expect")
+	return ok && strings.EqualFold(strings.TrimSpace(value), "100-continue")
 }
 
 func (request *Request) WriteTo(conn net.Conn) error {
@@ -319,6 +743,35 @@ func (request *Request) WriteTo(conn net.Conn) error {
 	return writer.Flush()
 }
 
+// WriteHeadTo writes the request line and the headers only, so the body can be sent
+// later with WriteBodyTo. The body must be delimited, as it is in requests read by ReadFrom.
+func (request *Request) WriteHeadTo(conn net.Conn) error {
+	writer := bufio.NewWriter(conn)
+
+	line := fmt.Sprintf("%s %s %s", request.Method, request.Url, request.Protocol)
+	logMessage(conn, true, line)
+	err := WriteLine(writer, line)
+	if err != nil {
+		return err
+	}
+
+	request.setHopByHopHeaders()
+	err = request.writeHeadersTo(writer)
+	if err != nil {
+		return err
+	}
+	return writer.Flush()
+}
+
+func (request *Request) WriteBodyTo(conn net.Conn) error {
+	writer := bufio.NewWriter(conn)
+	err := request.writeStreamedBodyTo(writer)
+	if err != nil {
+		return err
+	}
+	return writer.Flush()
+}
+
 type Response struct {
 	Protocol string
 	Code     int
@@ -328,10 +781,25 @@ type Response struct {
 
 var statusLineExp = regexp.MustCompile(`^(HTTP/\S+) (\d{3}) (.+)$`)
 
-func (response *Response) ReadFrom(conn net.Conn) error {
-	reader := bufio.NewReader(conn)
+// hasBody tells whether a response to a request with the given method has a body
+func (response *Response) hasBody(requestMethod string) bool {
+	switch {
+	case requestMethod == MethodHead:
+		return false
+	case requestMethod == MethodConnect && response.Code/100 == 2:
+		return false
+	case response.Code/100 == 1, response.Code == StatusNoContent, response.Code == StatusNotModified:
+		return false
+	}
+	return true
+}
+
+// ReadFrom reads a response to a request with the given method, which determines whether it has a body.
+func (response *Response) ReadFrom(conn net.Conn, requestMethod string) error {
+	reader := NewConn(conn).Reader
+	headers := newHeaderReader(reader)
 
-	line, err := ReadLine(reader)
+	line, err := headers.readLine(ErrHeaderTooLarge)
 	if err != nil {
 		return err
 	}
@@ -345,7 +813,31 @@ func (response *Response) ReadFrom(conn net.Conn) error {
 	response.Code, _ = strconv.Atoi(match[2])
 	response.Reason = match[3]
 
-	return response.MessageBase.ReadFrom(reader)
+	err = response.readHeadersFrom(headers, false)
+	if err != nil {
+		return err
+	}
+	if !response.hasBody(requestMethod) {
+		response.readBodyFrom(reader, 0, false)
+		return nil
+	}
+	length, err := response.bodyLength(false)
+	if err != nil {
+		return err
+	}
+	response.readBodyFrom(reader, length, false)
+	return nil
+}
+
+// Interim tells whether the response is an informational one, which is followed
+// by another response to the same request. 101 (Switching Protocols) is the last response instead.
+func (response *Response) Interim() bool {
+	return response.Code/100 == 1 && response.Code != StatusSwitchingProtocols
+}
+
+// Persistent tells whether the server is ready to receive more requests on the same connection.
+func (response *Response) Persistent() bool {
+	return response.persistent(response.Protocol)
 }
 
 func (response *Response) WriteTo(conn net.Conn) error {
@@ -358,7 +850,14 @@ func (response *Response) WriteTo(conn net.Conn) error {
 		return err
 	}
 
-	err = response.MessageBase.WriteTo(writer)
+	if response.Interim() {
+		// The connection is described by the final response
+		response.deleteHopByHopHeaders()
+		response.DeleteHeader("Connection")
+		err = response.writeHeadersTo(writer)
+	} else {
+		err = response.MessageBase.WriteTo(writer)
+	}
 	if err != nil {
 		return err
 	}
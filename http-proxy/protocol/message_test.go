@@ -0,0 +1,213 @@
+package protocol
+
+import (
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// relayResponse reads a response from the input and writes it like the proxy does
+func relayResponse(t *testing.T, input, requestMethod string) (*bufferConn, *Response) {
+	conn := newBufferConn([]byte(input))
+	response := new(Response)
+	if err := response.ReadFrom(conn, requestMethod); err != nil {
+		t.Fatal(err)
+	}
+	output := newBufferConn(nil)
+	response.KeepAlive = true
+	if err := response.WriteTo(output); err != nil {
+		t.Fatal(err)
+	}
+	if err := response.DiscardBody(); err != nil {
+		t.Fatal(err)
+	}
+	return output, response
+}
+
+func TestWriteChunkedResponseWithoutBody(t *testing.T) {
+	tests := []struct {
+		name, input, method string
+	}{
+		{"HEAD", "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\n\r\n", MethodHead},
+		{"204", "HTTP/1.1 204 No Content\r\nTransfer-Encoding: chunked\r\n\r\n", MethodGet},
+		{"304", "HTTP/1.1 304 Not Modified\r\nTransfer-Encoding: chunked\r\nETag: \"a\"\r\n\r\n", MethodGet},
+	}
+	next := "HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok"
+	for _, test := range tests {
+		output, _ := relayResponse(t, test.input+next, test.method)
+		written := output.written.String()
+		if !strings.HasSuffix(written, "\r\n\r\n") || strings.Contains(written, "\r\n0\r\n") {
+			t.Errorf("%s: body bytes are written: %q", test.name, written)
+		}
+
+		// The next response on the connection must stay aligned
+		conn := NewConn(newBufferConn([]byte(written + next)))
+		for _, method := range []string{test.method, MethodGet} {
+			response := new(Response)
+			if err := response.ReadFrom(conn, method); err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+			if err := response.DiscardBody(); err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+		}
+		if rest, _ := ioutil.ReadAll(conn); len(rest) > 0 {
+			t.Errorf("%s: excess data %q", test.name, rest)
+		}
+	}
+}
+
+func TestParseChunkLength(t *testing.T) {
+	tests := []struct {
+		line    string
+		want    uint64
+		wantErr bool
+	}{
+		{"1a", 0x1a, false},
+		{"1A", 0x1a, false},
+		{"0", 0, false},
+		{"5;name", 5, false},
+		{"5;name=value", 5, false},
+		{"5 ; name = value ;other", 5, false},
+		{`5;name="quoted \" value;"`, 5, false},
+		{"5;a=1;b=2", 5, false},
+		{"", 0, true},
+		{"x", 0, true},
+		{"-5", 0, true},
+		{"100000000", 0, true},
+		{"5;", 0, true},
+		{"5;=value", 0, true},
+		{"5;name=", 0, true},
+		{`5;name="unterminated`, 0, true},
+		{"5;name=a b", 0, true},
+		{"5;na(me", 0, true},
+		{"5 x", 0, true},
+	}
+	for _, test := range tests {
+		length, err := parseChunkLength(test.line)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%q: got error %v, want error %v", test.line, err, test.wantErr)
+		} else if !test.wantErr && length != test.want {
+			t.Errorf("%q: got %d, want %d", test.line, length, test.want)
+		}
+	}
+}
+
+func TestAllowedTrailers(t *testing.T) {
+	trailers := []Header{
+		{"Server-Timing", "db;dur=53"},
+		{"Content-Length", "5"},
+		{"transfer-encoding", "chunked"},
+		{"Set-Cookie", "a=b"},
+		{"X-Checksum", "abc"},
+		{"Content-Type", "text/html"},
+	}
+	want := []Header{{"Server-Timing", "db;dur=53"}, {"X-Checksum", "abc"}}
+	if got := AllowedTrailers(trailers); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got := AllowedTrailers(nil); got != nil {
+		t.Errorf("got %q for no trailers", got)
+	}
+}
+
+const chunkedWithTrailers = "HTTP/1.1 200 OK\r\nTransfer-Encoding: chunked\r\nTrailer: X-Checksum\r\n\r\n" +
+	"5;ext=1\r\nhello\r\n6\r\n world\r\n0\r\nX-Checksum: abc\r\nSet-Cookie: a=b\r\n\r\n"
+
+func TestChunkedTrailers(t *testing.T) {
+	response := new(Response)
+	if err := response.ReadFrom(newBufferConn([]byte(chunkedWithTrailers)), MethodGet); err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(response.Body.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "hello world" {
+		t.Errorf("got body %q", body)
+	}
+	want := []Header{{"X-Checksum", "abc"}, {"Set-Cookie", "a=b"}}
+	if trailers := response.Trailers(); !reflect.DeepEqual(trailers, want) {
+		t.Errorf("got trailers %q, want %q", trailers, want)
+	}
+
+	output, _ := relayResponse(t, chunkedWithTrailers, MethodGet)
+	written := output.written.String()
+	if !strings.HasSuffix(written, "0\r\nX-Checksum: abc\r\n\r\n") {
+		t.Errorf("the allowed trailers aren't relayed: %q", written)
+	}
+	if strings.Contains(written, "Set-Cookie") {
+		t.Errorf("a forbidden trailer is relayed: %q", written)
+	}
+}
+
+func TestTrailersBeforeTheEndOfBody(t *testing.T) {
+	response := new(Response)
+	if err := response.ReadFrom(newBufferConn([]byte(chunkedWithTrailers)), MethodGet); err != nil {
+		t.Fatal(err)
+	}
+	if trailers := response.Trailers(); trailers != nil {
+		t.Errorf("got trailers %q before the body is read", trailers)
+	}
+	if err := response.DiscardBody(); err != nil {
+		t.Fatal(err)
+	}
+	if trailers := response.Trailers(); len(trailers) != 2 {
+		t.Errorf("got trailers %q after the body is read", trailers)
+	}
+}
+
+func TestSetDelimitedByCloseDropsTrailers(t *testing.T) {
+	response := new(Response)
+	if err := response.ReadFrom(newBufferConn([]byte(chunkedWithTrailers)), MethodGet); err != nil {
+		t.Fatal(err)
+	}
+	response.SetDelimitedByClose()
+	output := newBufferConn(nil)
+	if err := response.WriteTo(output); err != nil {
+		t.Fatal(err)
+	}
+	written := output.written.String()
+	if !strings.HasSuffix(written, "\r\n\r\nhello world") {
+		t.Errorf("the body isn't sent as is: %q", written)
+	}
+	for _, key := range []string{"Transfer-Encoding", "Trailer", "X-Checksum"} {
+		if strings.Contains(written, key) {
+			t.Errorf("%s is sent: %q", key, written)
+		}
+	}
+}
+
+func TestRepeatedContentLength(t *testing.T) {
+	tests := []string{
+		"HTTP/1.1 200 OK\r\nContent-Length: 5, 5\r\n\r\nhello",
+		"HTTP/1.1 200 OK\r\nContent-Length: 5\r\nContent-Length: 5\r\n\r\nhello",
+		"HTTP/1.1 200 OK\r\nContent-Length: 5,5 , 5\r\n\r\nhello",
+	}
+	for _, input := range tests {
+		output, response := relayResponse(t, input, MethodGet)
+		want := []Header{{"Content-Length", "5"}, {"Connection", "keep-alive"}}
+		if !reflect.DeepEqual(response.Headers, want) {
+			t.Errorf("%q: got headers %q", input, response.Headers)
+		}
+		written := output.written.String()
+		if !strings.HasSuffix(written, "Content-Length: 5\r\nConnection: keep-alive\r\n\r\nhello") {
+			t.Errorf("%q: got %q", input, written)
+		}
+	}
+
+	request := new(Request)
+	err := request.ReadFrom(newBufferConn([]byte("POST / HTTP/1.1\r\nContent-Length: 3, 3\r\n\r\nabc")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := request.Header("Content-Length"); value != "3" {
+		t.Errorf("got request Content-Length %q", value)
+	}
+
+	err = new(Response).ReadFrom(newBufferConn([]byte("HTTP/1.1 200 OK\r\nContent-Length: 5, 6\r\n\r\nhello")), MethodGet)
+	if err == nil {
+		t.Error("conflicting values are accepted")
+	}
+}
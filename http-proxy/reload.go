@@ -0,0 +1,138 @@
+package main
+
+import (
+	"./protocol"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"path"
+	"regexp"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const watchInterval = 2 * time.Second
+
+// Settings is a snapshot of everything loaded from the config and the templates.
+// It's never modified after loading, so requests in progress keep using
+// their snapshot while a reloaded one is swapped in.
+type Settings struct {
+	Config
+
+	allowedTunnelAddrRegexp      *regexp.Regexp
+	allowedUpgradeAddrRegexp     *regexp.Regexp
+	httpClients, tunnelClients   ClientLists
+	destinations                 *DestinationPolicy
+	interceptionBypassRegexps    []*regexp.Regexp
+	urlRules                     []URLRule
+	blockRules                   []BlockRule
+	headerRules                  []HeaderRule
+	urlRewrites                  []URLRewrite
+	filterList                   *FilterList
+	rulesVersion                 string
+	parents                      map[string]*Parent
+	routes                       []Route
+	credentials                  *Credentials
+	users                        map[string]*Settings // the settings with the policies of users applied
+	username                     string               // the user the settings are made for by forUser
+	certificateAuthority         *CertificateAuthority
+	errorTemplate, blockTemplate *template.Template
+}
+
+var settingsValue atomic.Value
+
+func currentSettings() *Settings {
+	return settingsValue.Load().(*Settings)
+}
+
+// storeSettings makes the settings current, including the parts kept by the protocol package
+func storeSettings(settings *Settings) {
+	protocol.SetHeaderLimits(protocol.HeaderLimits{MaxBytes: settings.MaxHeaderBytes, MaxCount: settings.MaxHeaderCount})
+	settingsValue.Store(settings)
+}
+
+func reloadSettings(reason string) {
+	log.Printf("reloading the config (%s)\n", reason)
+	previous := currentSettings()
+	settings, err := loadSettings(previous)
+	if err != nil {
+		log.Printf("new config is rejected, the old one stays active: %s\n", err)
+		return
+	}
+	if settings.ListenOn != previous.ListenOn || settings.SocksListenOn != previous.SocksListenOn ||
+		settings.ListenOnUnix != previous.ListenOnUnix ||
+		settings.PoolMaxIdle != previous.PoolMaxIdle ||
+		settings.PoolMaxConnsPerHost != previous.PoolMaxConnsPerHost ||
+		settings.PoolIdleTimeout != previous.PoolIdleTimeout ||
+		settings.CacheMemorySize != previous.CacheMemorySize || settings.CacheDiskSize != previous.CacheDiskSize ||
+		settings.CacheDir != previous.CacheDir {
+		log.Println("changes of the listening addresses, the connection pool and the cache limits take effect after a restart")
+	}
+	storeSettings(settings)
+}
+
+type fileState struct {
+	size    int64
+	modTime time.Time
+}
+
+// watchedFiles returns the state of the files that the settings are loaded from
+func watchedFiles(settings *Settings) map[string]fileState {
+	filenames := []string{configFilename}
+	if infos, err := ioutil.ReadDir(templateDir); err == nil {
+		for _, info := range infos {
+			filenames = append(filenames, path.Join(templateDir, info.Name()))
+		}
+	}
+	if settings.CredentialsFile != "" {
+		filenames = append(filenames, resolveConfigPath(settings.CredentialsFile))
+	}
+	for _, filename := range settings.FilterLists {
+		filenames = append(filenames, resolveConfigPath(filename))
+	}
+
+	result := make(map[string]fileState)
+	for _, filename := range filenames {
+		if info, err := os.Stat(filename); err == nil {
+			result[filename] = fileState{info.Size(), info.ModTime()}
+		}
+	}
+	return result
+}
+
+func filesChanged(before, after map[string]fileState) bool {
+	if len(before) != len(after) {
+		return true
+	}
+	for filename, state := range after {
+		if before[filename] != state {
+			return true
+		}
+	}
+	return false
+}
+
+// watchSettings reloads the settings on SIGHUP or when the config, a template, a filter list
+// or the credentials file is changed
+func watchSettings() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	ticker := time.NewTicker(watchInterval)
+
+	files := watchedFiles(currentSettings())
+	for {
+		select {
+		case <-signals:
+			reloadSettings("SIGHUP received")
+		case <-ticker.C:
+			if !filesChanged(files, watchedFiles(currentSettings())) {
+				continue
+			}
+			reloadSettings("files changed")
+		}
+		files = watchedFiles(currentSettings())
+	}
+}
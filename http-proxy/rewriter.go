@@ -0,0 +1,266 @@
+package main
+
+import (
+	"github.com/andybalholm/cascadia"
+	"golang.org/x/net/html"
+	"io"
+	"regexp"
+	"strings"
+)
+
+const removedElementComment = "<!-- An advertisment here was removed -->"
+
+// Pseudo-classes that depend on the content or the following siblings of an element,
+// so they can't be evaluated when its start tag streams past
+var lookaheadSelectorRegexp = regexp.MustCompile(`(?i):(has|haschild|contains|containsown|matches|matchesown|` +
+	`empty|last-child|last-of-type|only-child|only-of-type|nth-last-child|nth-last-of-type)\b`)
+
+func needsLookahead(selector string) bool {
+	return lookaheadSelectorRegexp.MatchString(selector)
+}
+
+var voidElements = map[string]bool{
+	"area": true, "base": true, "br": true, "col": true, "embed": true, "hr": true, "img": true,
+	"input": true, "keygen": true, "link": true, "meta": true, "param": true, "source": true,
+	"track": true, "wbr": true,
+}
+
+var paragraphClosers = []string{
+	"address", "article", "aside", "blockquote", "div", "dl", "fieldset", "footer", "form",
+	"h1", "h2", "h3", "h4", "h5", "h6", "header", "hr", "main", "nav", "ol", "p", "pre",
+	"section", "table", "ul",
+}
+
+// impliedEndTags lists elements whose end tag may be omitted
+// when the current element is followed by the given start tag
+var impliedEndTags = map[string][]string{
+	"li":     {"li"},
+	"dt":     {"dt", "dd"},
+	"dd":     {"dt", "dd"},
+	"option": {"option"},
+	"tr":     {"tr", "td", "th"},
+	"td":     {"td", "th"},
+	"th":     {"td", "th"},
+}
+
+func init() {
+	for _, name := range paragraphClosers {
+		impliedEndTags[name] = append(impliedEndTags[name], "p")
+	}
+}
+
+type openElement struct {
+	node    *html.Node
+	removed bool
+	after   string // snippets injected after the element is closed
+}
+
+// streamRewriter removes elements matching the selectors and inserts injections
+// while copying a document token by token. It keeps only a skeleton of the document
+// (open elements and their preceding element siblings), so the selectors can't look
+// at the content of an element or at the siblings after it.
+type streamRewriter struct {
+	selectors  []cascadia.Selector
+	injections []Injection
+
+	root     *html.Node
+	stack    []openElement
+	removing int // depth of the outermost removed element in stack, or -1
+	removed  int
+	injected map[string]bool
+}
+
+func newStreamRewriter(selectors []cascadia.Selector, injections []Injection) *streamRewriter {
+	return &streamRewriter{
+		selectors:  selectors,
+		injections: injections,
+		root:       &html.Node{Type: html.DocumentNode},
+		removing:   -1,
+		injected:   make(map[string]bool),
+	}
+}
+
+func (rewriter *streamRewriter) current() *html.Node {
+	if len(rewriter.stack) == 0 {
+		return rewriter.root
+	}
+	return rewriter.stack[len(rewriter.stack)-1].node
+}
+
+// pop closes the open elements starting from the given depth and returns the snippets
+// injected after them. Their children are dropped from the skeleton, since closed elements
+// are only needed as preceding siblings.
+func (rewriter *streamRewriter) pop(depth int) string {
+	var after strings.Builder
+	for i := len(rewriter.stack) - 1; i >= depth; i-- {
+		node := rewriter.stack[i].node
+		for node.FirstChild != nil {
+			node.RemoveChild(node.FirstChild)
+		}
+		after.WriteString(rewriter.stack[i].after)
+	}
+	rewriter.stack = rewriter.stack[:depth]
+	if rewriter.removing >= depth {
+		rewriter.removing = -1
+	}
+	return after.String()
+}
+
+// positionSnippets returns the snippets for a fixed position unless they were already injected
+func (rewriter *streamRewriter) positionSnippets(position string) string {
+	if rewriter.injected[position] {
+		return ""
+	}
+	rewriter.injected[position] = true
+
+	var result strings.Builder
+	for _, injection := range rewriter.injections {
+		if injection.Position == position {
+			result.WriteString(injection.HTML)
+		}
+	}
+	return result.String()
+}
+
+// elementSnippets returns the snippets injected before and after an element
+func (rewriter *streamRewriter) elementSnippets(node *html.Node) (string, string) {
+	var before, after strings.Builder
+	for _, injection := range rewriter.injections {
+		if injection.Matcher == nil || !injection.Matcher.Match(node) {
+			continue
+		}
+		if injection.Position == PositionBefore {
+			before.WriteString(injection.HTML)
+		} else {
+			after.WriteString(injection.HTML)
+		}
+	}
+	return before.String(), after.String()
+}
+
+func (rewriter *streamRewriter) matches(node *html.Node) bool {
+	for _, selector := range rewriter.selectors {
+		if selector.Match(node) {
+			return true
+		}
+	}
+	return false
+}
+
+// startTag adds an element to the skeleton. It returns the text to be written before and after
+// the tag and tells whether the tag is inside a removed subtree.
+func (rewriter *streamRewriter) startTag(token html.Token, selfClosing bool) (string, string, bool) {
+	var before, after string
+	for {
+		current := rewriter.current()
+		if current.Type != html.ElementNode || !containsString(impliedEndTags[token.Data], current.Data) {
+			break
+		}
+		before += rewriter.pop(len(rewriter.stack) - 1)
+	}
+	if token.Data == "body" {
+		// <head> may be closed implicitly
+		before += rewriter.positionSnippets(PositionHeadEnd)
+		after = rewriter.positionSnippets(PositionBodyStart)
+	}
+
+	node := &html.Node{
+		Type:     html.ElementNode,
+		DataAtom: token.DataAtom,
+		Data:     token.Data,
+		Attr:     token.Attr,
+	}
+	rewriter.current().AppendChild(node)
+
+	element := openElement{node: node, removed: rewriter.removing != -1}
+	if !element.removed && rewriter.matches(node) {
+		element.removed = true
+		rewriter.removed++
+		rewriter.removing = len(rewriter.stack)
+	}
+	if !element.removed {
+		var elementBefore string
+		elementBefore, element.after = rewriter.elementSnippets(node)
+		before += elementBefore
+	}
+	rewriter.stack = append(rewriter.stack, element)
+	if selfClosing || voidElements[token.Data] {
+		after += rewriter.pop(len(rewriter.stack) - 1)
+	}
+	return before, after, element.removed
+}
+
+// endTag closes the nearest open element with the given name. It returns the text to be written
+// before and after the tag and tells whether the tag is inside a removed subtree.
+func (rewriter *streamRewriter) endTag(name string) (string, string, bool) {
+	var before string
+	switch name {
+	case "head":
+		before = rewriter.positionSnippets(PositionHeadEnd)
+	case "body", "html":
+		before = rewriter.positionSnippets(PositionBodyEnd)
+	}
+
+	for i := len(rewriter.stack) - 1; i >= 0; i-- {
+		if rewriter.stack[i].node.Data == name {
+			removed := rewriter.stack[i].removed
+			return before, rewriter.pop(i), removed
+		}
+	}
+	return before, "", rewriter.removing != -1
+}
+
+func containsString(items []string, value string) bool {
+	for _, item := range items {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (rewriter *streamRewriter) Rewrite(reader io.Reader, writer io.Writer) error {
+	tokenizer := html.NewTokenizer(reader)
+	for {
+		tokenType := tokenizer.Next()
+		if tokenType == html.ErrorToken {
+			if tokenizer.Err() != io.EOF {
+				return tokenizer.Err()
+			}
+			break
+		}
+		// Token lowercases tag names in the buffer, so the original text is copied first
+		raw := string(tokenizer.Raw())
+
+		var before, after string
+		var removed bool
+		switch tokenType {
+		case html.StartTagToken, html.SelfClosingTagToken:
+			wasRemoving := rewriter.removing != -1
+			before, after, removed = rewriter.startTag(tokenizer.Token(), tokenType == html.SelfClosingTagToken)
+			if removed && !wasRemoving {
+				raw = removedElementComment
+				removed = false
+			}
+		case html.EndTagToken:
+			name, _ := tokenizer.TagName()
+			before, after, removed = rewriter.endTag(string(name))
+		default:
+			removed = rewriter.removing != -1
+		}
+		if removed {
+			raw = ""
+		}
+
+		_, err := io.WriteString(writer, before+raw+after)
+		if err != nil {
+			return err
+		}
+	}
+
+	// The document may lack the tags marking the positions
+	_, err := io.WriteString(writer, rewriter.positionSnippets(PositionHeadEnd)+
+		rewriter.positionSnippets(PositionBodyStart)+rewriter.positionSnippets(PositionBodyEnd)+
+		removalSummary(rewriter.removed))
+	return err
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"github.com/andybalholm/cascadia"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestNeedsLookahead(t *testing.T) {
+	tests := []struct {
+		selector string
+		want     bool
+	}{
+		{".ad", false},
+		{"div > .ad + p", false},
+		{"li:first-child", false},
+		{"li:nth-child(2)", false},
+		{"div:has(> .ad)", true},
+		{"p:contains(Sponsored)", true},
+		{"li:last-child", true},
+		{"div:EMPTY", true},
+		{"li:nth-last-child(2)", true},
+	}
+	for _, test := range tests {
+		if got := needsLookahead(test.selector); got != test.want {
+			t.Errorf("needsLookahead(%q) = %v, want %v", test.selector, got, test.want)
+		}
+	}
+}
+
+func newTestRewriter(t *testing.T, selectors []string, injectionConfigs []InjectionConfig) *streamRewriter {
+	var matchers []cascadia.Selector
+	for _, selector := range selectors {
+		matchers = append(matchers, cascadia.MustCompile(selector))
+	}
+	var injections []Injection
+	for _, injectionConfig := range injectionConfigs {
+		injection, err := compileInjection(injectionConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		injections = append(injections, injection)
+	}
+	return newStreamRewriter(matchers, injections)
+}
+
+// rewritePage rewrites a page read in single bytes and returns it without the summary at the end
+func rewritePage(t *testing.T, selectors []string, injections []InjectionConfig, page string) (string, int) {
+	rewriter := newTestRewriter(t, selectors, injections)
+	var output strings.Builder
+	if err := rewriter.Rewrite(iotest.OneByteReader(strings.NewReader(page)), &output); err != nil {
+		t.Fatal(err)
+	}
+	summary := removalSummary(rewriter.removed)
+	if !strings.HasSuffix(output.String(), summary) {
+		t.Fatalf("no summary at the end of %q", output.String())
+	}
+	return strings.TrimSuffix(output.String(), summary), rewriter.removed
+}
+
+func TestStreamRewriterRemoval(t *testing.T) {
+	tests := []struct {
+		name      string
+		selectors []string
+		page      string
+		want      string
+		removed   int
+	}{
+		{"nested", []string{".ad"}, `<div class="ad"><div><p>x</p></div></div><p>ok</p>`,
+			removedElementComment + `<p>ok</p>`, 1},
+		{"void element", []string{"img.ad"}, `<p><img class="ad" src="a.png">text</p>`,
+			`<p>` + removedElementComment + `text</p>`, 1},
+		{"self-closing", []string{".ad"}, `<p><span class="ad"/>text</p>`, `<p>` + removedElementComment + `text</p>`, 1},
+		{"implied end tags", []string{"li.ad"}, `<ul><li class="ad">a<li>b</ul>`,
+			`<ul>` + removedElementComment + `<li>b</ul>`, 1},
+		{"paragraph closed by a div", []string{"p.ad"}, `<p class="ad">a<div>b</div>`,
+			removedElementComment + `<div>b</div>`, 1},
+		{"preceding sibling", []string{"h2 + .ad"}, `<h2>t</h2><div class="ad">x</div><div class="ad">y</div>`,
+			`<h2>t</h2>` + removedElementComment + `<div class="ad">y</div>`, 1},
+		{"child of a removed element", []string{".ad", "span"}, `<div class="ad"><span>x</span></div><span>y</span>`,
+			removedElementComment + removedElementComment, 2},
+		{"original case kept", []string{".ad"}, `<DIV Class="keep">A</DIV><Div class="ad">B</Div>`,
+			`<DIV Class="keep">A</DIV>` + removedElementComment, 1},
+		{"stray end tag", []string{".ad"}, `<p>a</span>b</p>`, `<p>a</span>b</p>`, 0},
+	}
+	for _, test := range tests {
+		output, removed := rewritePage(t, test.selectors, nil, test.page)
+		if output != test.want || removed != test.removed {
+			t.Errorf("%s: got %q with %d removed, want %q with %d", test.name, output, removed, test.want, test.removed)
+		}
+	}
+}
+
+func TestStreamRewriterInjection(t *testing.T) {
+	injections := []InjectionConfig{
+		{Position: PositionHeadEnd, CSS: "a{}"},
+		{Position: PositionBodyStart, HTML: "<i>start</i>"},
+		{Position: PositionBodyEnd, JS: "run()"},
+		{Position: PositionBefore, Selector: "h1", HTML: "<hr>"},
+		{Position: PositionAfter, Selector: "h1", HTML: "<b>after</b>"},
+	}
+	tests := []struct {
+		name, page, want string
+	}{
+		{"all tags", `<html><head><title>t</title></head><body><h1>h</h1></body></html>`,
+			`<html><head><title>t</title><style>a{}</style></head><body><i>start</i><hr><h1>h</h1><b>after</b>` +
+				`<script>run()</script></body></html>`},
+		{"implicit head end", `<html><head><title>t</title><body>text</body></html>`,
+			`<html><head><title>t</title><style>a{}</style><body><i>start</i>text<script>run()</script></body></html>`},
+		{"no tags", `text`, `text<style>a{}</style><i>start</i><script>run()</script>`},
+	}
+	for _, test := range tests {
+		output, _ := rewritePage(t, nil, injections, test.page)
+		if output != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, output, test.want)
+		}
+	}
+
+	// Nothing is injected next to a removed element
+	output, _ := rewritePage(t, []string{"h1"}, injections[3:], `<h1>h</h1>`)
+	if output != removedElementComment {
+		t.Errorf("got %q around a removed element", output)
+	}
+}
+
+func TestStreamRewriterStreams(t *testing.T) {
+	inputReader, inputWriter := io.Pipe()
+	outputReader, outputWriter := io.Pipe()
+	rewriter := newTestRewriter(t, []string{".ad"}, nil)
+	go func() {
+		outputWriter.CloseWithError(rewriter.Rewrite(inputReader, outputWriter))
+	}()
+
+	inputWriter.Write([]byte(`<html><body><p>first</p>`))
+	received := make(chan string, 1)
+	go func() {
+		var output []byte
+		buffer := make([]byte, 1024)
+		for !strings.Contains(string(output), "</p>") {
+			n, err := outputReader.Read(buffer)
+			if err != nil {
+				break
+			}
+			output = append(output, buffer[:n]...)
+		}
+		received <- string(output)
+	}()
+	select {
+	case output := <-received:
+		if output != `<html><body><p>first</p>` {
+			t.Errorf("got %q", output)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the beginning of the page isn't written before the rest is read")
+	}
+
+	inputWriter.Write([]byte(`<div class="ad">x</div></body></html>`))
+	inputWriter.Close()
+	rest, err := ioutil.ReadAll(outputReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := removedElementComment + `</body></html>` + removalSummary(1); string(rest) != want {
+		t.Errorf("got %q, want %q", rest, want)
+	}
+}
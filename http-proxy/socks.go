@@ -0,0 +1,377 @@
+package main
+
+import (
+	"./protocol"
+	"bufio"
+	"bytes"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// SOCKS protocol constants (RFC 1928, RFC 1929)
+const (
+	socksVersion          = 5
+	socksAuthNone         = 0
+	socksAuthPassword     = 2
+	socksAuthUnacceptable = 0xff
+	socksPasswordVersion  = 1
+	socksPasswordSuccess  = 0
+	socksCommandConnect   = 1
+	socksAddrIPv4         = 1
+	socksAddrDomain       = 3
+	socksAddrIPv6         = 4
+)
+
+// Replies of a SOCKS server
+const (
+	socksSucceeded          = 0
+	socksGeneralFailure     = 1
+	socksNotAllowed         = 2
+	socksNetworkUnreachable = 3
+	socksHostUnreachable    = 4
+	socksConnectionRefused  = 5
+	socksTTLExpired         = 6
+	socksCommandUnknown     = 7
+	socksAddrUnknown        = 8
+)
+
+var socksReplies = map[byte]string{
+	socksGeneralFailure:     "general SOCKS server failure",
+	socksNotAllowed:         "connection not allowed by ruleset",
+	socksNetworkUnreachable: "network unreachable",
+	socksHostUnreachable:    "host unreachable",
+	socksConnectionRefused:  "connection refused",
+	socksTTLExpired:         "TTL expired",
+	socksCommandUnknown:     "command not supported",
+	socksAddrUnknown:        "address type not supported",
+}
+
+// encodeSocksAddr encodes host:port as the address fields of a SOCKS request or reply
+func encodeSocksAddr(addr string) ([]byte, error) {
+	host, portString, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port in %s", addr)
+	}
+
+	var result []byte
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("host name %s is too long", host)
+		}
+		result = append([]byte{socksAddrDomain, byte(len(host))}, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		result = append([]byte{socksAddrIPv4}, ip4...)
+	} else {
+		result = append([]byte{socksAddrIPv6}, ip...)
+	}
+	return append(result, byte(port>>8), byte(port)), nil
+}
+
+// readSocksAddr reads the address fields of a SOCKS request or reply
+func readSocksAddr(reader *bufio.Reader) (string, error) {
+	addrType, err := reader.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	var host string
+	switch addrType {
+	case socksAddrIPv4, socksAddrIPv6:
+		ip := make(net.IP, net.IPv4len)
+		if addrType == socksAddrIPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		_, err = io.ReadFull(reader, ip)
+		host = ip.String()
+	case socksAddrDomain:
+		var length byte
+		length, err = reader.ReadByte()
+		if err == nil {
+			name := make([]byte, length)
+			_, err = io.ReadFull(reader, name)
+			host = string(name)
+		}
+	default:
+		return "", fmt.Errorf("unknown SOCKS address type %d", addrType)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	var port uint16
+	err = binary.Read(reader, binary.BigEndian, &port)
+	if err != nil {
+		return "", err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), nil
+}
+
+func readSocksVersion(reader *bufio.Reader, expected byte) error {
+	version, err := reader.ReadByte()
+	if err != nil {
+		return err
+	}
+	if version != expected {
+		return fmt.Errorf("unexpected SOCKS version %d", version)
+	}
+	return nil
+}
+
+// socksConnect asks a SOCKS5 server on conn to connect to addr. If the host is a name,
+// it's resolved by the server. Empty username means that authentication isn't offered.
+func socksConnect(conn io.ReadWriter, reader *bufio.Reader, addr, username, password string) error {
+	methods := []byte{socksAuthNone}
+	if username != "" {
+		methods = append(methods, socksAuthPassword)
+	}
+	_, err := conn.Write(append([]byte{socksVersion, byte(len(methods))}, methods...))
+	if err != nil {
+		return err
+	}
+
+	err = readSocksVersion(reader, socksVersion)
+	if err != nil {
+		return err
+	}
+	method, err := reader.ReadByte()
+	if err != nil {
+		return err
+	}
+	switch {
+	case method == socksAuthNone:
+	case method == socksAuthPassword && username != "":
+		if len(username) > 255 || len(password) > 255 {
+			return errors.New("SOCKS credentials are too long")
+		}
+		request := append([]byte{socksPasswordVersion, byte(len(username))}, username...)
+		request = append(append(request, byte(len(password))), password...)
+		_, err = conn.Write(request)
+		if err != nil {
+			return err
+		}
+		err = readSocksVersion(reader, socksPasswordVersion)
+		if err != nil {
+			return err
+		}
+		status, err := reader.ReadByte()
+		if err != nil {
+			return err
+		}
+		if status != socksPasswordSuccess {
+			return errors.New("SOCKS server rejected the credentials")
+		}
+	default:
+		return errors.New("SOCKS server doesn't accept any offered authentication method")
+	}
+
+	encodedAddr, err := encodeSocksAddr(addr)
+	if err != nil {
+		return err
+	}
+	_, err = conn.Write(append([]byte{socksVersion, socksCommandConnect, 0}, encodedAddr...))
+	if err != nil {
+		return err
+	}
+
+	err = readSocksVersion(reader, socksVersion)
+	if err != nil {
+		return err
+	}
+	reply, err := reader.ReadByte()
+	if err != nil {
+		return err
+	}
+	if _, err = reader.ReadByte(); err != nil { // reserved
+		return err
+	}
+	if _, err = readSocksAddr(reader); err != nil { // the address bound by the server
+		return err
+	}
+	if reply != socksSucceeded {
+		message, ok := socksReplies[reply]
+		if !ok {
+			message = fmt.Sprintf("unknown reply %d", reply)
+		}
+		return fmt.Errorf("SOCKS server can't connect to %s: %s", addr, message)
+	}
+	return nil
+}
+
+func sendSocksReply(conn net.Conn, reply byte, boundAddr string) error {
+	encodedAddr, err := encodeSocksAddr(boundAddr)
+	if err != nil {
+		encodedAddr = []byte{socksAddrIPv4, 0, 0, 0, 0, 0, 0}
+	}
+	_, err = conn.Write(append([]byte{socksVersion, reply, 0}, encodedAddr...))
+	return err
+}
+
+// socksReplyFor chooses the reply that describes a failed connection to the destination
+func socksReplyFor(err error) byte {
+	var dnsErr *net.DNSError
+	switch {
+	case errors.Is(err, errDestinationDenied):
+		return socksNotAllowed
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return socksConnectionRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return socksNetworkUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.As(err, &dnsErr):
+		return socksHostUnreachable
+	}
+	return socksGeneralFailure
+}
+
+// socksAuthenticate negotiates the authentication method and checks the credentials of a client
+// against SocksUsers and the credentials file. It returns the username, which is empty
+// if no authentication is configured.
+func socksAuthenticate(settings *Settings, conn net.Conn, reader *bufio.Reader) (string, error) {
+	err := readSocksVersion(reader, socksVersion)
+	if err != nil {
+		return "", err
+	}
+	count, err := reader.ReadByte()
+	if err != nil {
+		return "", err
+	}
+	methods := make([]byte, count)
+	_, err = io.ReadFull(reader, methods)
+	if err != nil {
+		return "", err
+	}
+
+	required := byte(socksAuthNone)
+	if len(settings.SocksUsers) > 0 || settings.credentials != nil {
+		required = socksAuthPassword
+	}
+	if bytes.IndexByte(methods, required) == -1 {
+		conn.Write([]byte{socksVersion, socksAuthUnacceptable})
+		return "", errors.New("client doesn't offer an acceptable authentication method")
+	}
+	_, err = conn.Write([]byte{socksVersion, required})
+	if err != nil || required == socksAuthNone {
+		return "", err
+	}
+
+	err = readSocksVersion(reader, socksPasswordVersion)
+	if err != nil {
+		return "", err
+	}
+	var credentials [2][]byte
+	for i := range credentials {
+		length, err := reader.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		credentials[i] = make([]byte, length)
+		_, err = io.ReadFull(reader, credentials[i])
+		if err != nil {
+			return "", err
+		}
+	}
+	username := string(credentials[0])
+	password, ok := settings.SocksUsers[username]
+	valid := ok && subtle.ConstantTimeCompare([]byte(password), credentials[1]) == 1
+	if !valid && settings.credentials != nil {
+		valid = settings.credentials.Check(username, string(credentials[1]))
+	}
+	if !valid {
+		conn.Write([]byte{socksPasswordVersion, 1})
+		return "", fmt.Errorf("invalid credentials for user %s", username)
+	}
+	_, err = conn.Write([]byte{socksPasswordVersion, socksPasswordSuccess})
+	return username, err
+}
+
+func handleSocksClient(settings *Settings, clientConn *protocol.Conn) error {
+	// The handshake takes the place of the request headers, so it's limited the same way
+	if settings.HeaderReadTimeout > 0 {
+		clientConn.SetReadDeadline(time.Now().Add(time.Duration(settings.HeaderReadTimeout) * time.Second))
+	}
+	reader := clientConn.Reader
+	username, err := socksAuthenticate(settings, clientConn, reader)
+	if err != nil {
+		return err
+	}
+
+	err = readSocksVersion(reader, socksVersion)
+	if err != nil {
+		return err
+	}
+	command, err := reader.ReadByte()
+	if err != nil {
+		return err
+	}
+	if _, err = reader.ReadByte(); err != nil { // reserved
+		return err
+	}
+	addr, err := readSocksAddr(reader)
+	if err != nil {
+		sendSocksReply(clientConn, socksAddrUnknown, "")
+		return err
+	}
+	clientConn.SetReadDeadline(time.Time{})
+
+	line := fmt.Sprintf("SOCKS5 %d %s", command, addr)
+	if command == socksCommandConnect {
+		line = "SOCKS5 CONNECT " + addr
+	}
+	if username != "" {
+		line += " (user " + username + ")"
+		settings = settings.forUser(username)
+	}
+	log.Printf("<- %s  %s\n", clientConn.RemoteAddr(), line)
+
+	if command != socksCommandConnect {
+		sendSocksReply(clientConn, socksCommandUnknown, "")
+		return fmt.Errorf("SOCKS command %d isn't supported", command)
+	}
+	if !settings.tunnelAddrAllowed(addr) {
+		sendSocksReply(clientConn, socksNotAllowed, "")
+		return fmt.Errorf("address %s isn't allowed for CONNECT", addr)
+	}
+
+	serverConn, err := dialTunnel(settings.destinations, settings.parentFor(addr), addr)
+	if err != nil {
+		sendSocksReply(clientConn, socksReplyFor(err), "")
+		return err
+	}
+	err = sendSocksReply(clientConn, socksSucceeded, serverConn.LocalAddr().String())
+	if err != nil {
+		serverConn.Close()
+		return err
+	}
+	relayTunnel(clientConn, serverConn)
+	return nil
+}
+
+func runHandleSocksClient(rawConn net.Conn) {
+	clientConn := protocol.NewConn(rawConn)
+	settings := currentSettings()
+	if !settings.tunnelClients.Allows(clientConn.RemoteAddr()) {
+		log.Printf("client %s isn't allowed to use SOCKS5\n", clientConn.RemoteAddr())
+		clientConn.Close()
+		return
+	}
+	err := handleSocksClient(settings, clientConn)
+	if err != nil {
+		log.Printf("error on handling a SOCKS client: %s\n", err)
+		clientConn.Close()
+	}
+}
+
+func listenSocks(addr string) {
+	log.Printf("listening for SOCKS5 on %s\n", addr)
+	connections.serve(connections.listen("tcp", addr), runHandleSocksClient)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"./protocol"
+	"bufio"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// acceptSocksClient makes a connection to a SOCKS5 server handled by handleSocksClient.
+// The result of the handler is sent to the channel.
+func acceptSocksClient(t *testing.T, settings *Settings) (net.Conn, chan error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	server, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := make(chan error, 1)
+	go func() {
+		serverConn := protocol.NewConn(server)
+		err := handleSocksClient(settings, serverConn)
+		if err != nil {
+			serverConn.Close()
+		}
+		result <- err
+	}()
+	return client, result
+}
+
+func TestSocksHandshakeTimeout(t *testing.T) {
+	settings := loadTestSettings(t, map[string]interface{}{"HeaderReadTimeout": 1, "KeepAliveTimeout": 60})
+	storeSettings(settings)
+	client, result := acceptSocksClient(t, settings)
+	// The greeting is never finished
+	if _, err := client.Write([]byte{socksVersion, 2, socksAuthNone}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-result:
+		if err == nil {
+			t.Error("a stalled handshake succeeds")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("a stalled handshake isn't timed out by HeaderReadTimeout")
+	}
+}
+
+// echoServer accepts one connection and sends back what it receives
+func echoServer(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		io.Copy(conn, conn)
+		conn.Close()
+	}()
+	return listener.Addr().String()
+}
+
+func TestSocksConnect(t *testing.T) {
+	settings := loadTestSettings(t, map[string]interface{}{
+		"HeaderReadTimeout": 5,
+		"AllowDestinations": []string{"127.0.0.0/8"},
+		"SocksUsers":        map[string]string{"alice": "secret"},
+	})
+	storeSettings(settings)
+	addr := echoServer(t)
+
+	client, result := acceptSocksClient(t, settings)
+	if err := socksConnect(client, bufio.NewReader(client), addr, "alice", "wrong"); err == nil {
+		t.Error("wrong credentials are accepted")
+	}
+	if err := <-result; err == nil {
+		t.Error("the handler succeeds with wrong credentials")
+	}
+
+	client, result = acceptSocksClient(t, settings)
+	if err := socksConnect(client, bufio.NewReader(client), addr, "", ""); err == nil {
+		t.Error("a client without credentials is accepted")
+	}
+	<-result
+
+	client, result = acceptSocksClient(t, settings)
+	reader := bufio.NewReader(client)
+	if err := socksConnect(client, reader, addr, "alice", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	reply := make([]byte, 4)
+	if _, err := io.ReadFull(reader, reply); err != nil || string(reply) != "ping" {
+		t.Fatalf("got %q through the tunnel, error %v", reply, err)
+	}
+	client.(*net.TCPConn).CloseWrite()
+	if err := <-result; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestSocksDeniedDestination(t *testing.T) {
+	settings := loadTestSettings(t, map[string]interface{}{"HeaderReadTimeout": 5})
+	storeSettings(settings)
+	addr := echoServer(t)
+
+	client, result := acceptSocksClient(t, settings)
+	if err := socksConnect(client, bufio.NewReader(client), addr, "", ""); err == nil {
+		t.Error("a connection to the loopback network is made")
+	}
+	if err := <-result; err == nil {
+		t.Error("the handler succeeds for a denied destination")
+	}
+}
@@ -0,0 +1,12 @@
+<!DOCTYPE html>
+<html>
+<head>
+    <title>403 Forbidden</title>
+</head>
+<body>
+    <h1>403 Forbidden</h1>
+    <p>The request to <code>{{.URL}}</code> was blocked by {{.Rule}}.</p>
+    <hr>
+    <address>{{.ServerName}} at {{.ListenOn}}</address>
+</body>
+</html>
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"./protocol"
+	"errors"
+	"log"
+	"strings"
+)
+
+// upgradeAllowed tells whether a request may switch the connection to an origin to another
+// protocol, such as WebSocket. Otherwise the Upgrade header isn't forwarded,
+// and the origin answers as usual.
+func (settings *Settings) upgradeAllowed(addr string, request *protocol.Request) bool {
+	protocols := request.UpgradeProtocols()
+	if protocols == nil {
+		return false
+	}
+	if !settings.allowedUpgradeAddrRegexp.MatchString(addr) {
+		log.Printf("upgrade to %s isn't allowed for %s\n", strings.Join(protocols, ", "), addr)
+		return false
+	}
+	for _, offered := range protocols {
+		// Protocols may have a version, like "websocket/13"
+		name := strings.SplitN(offered, "/", 2)[0]
+		allowed := false
+		for _, item := range settings.UpgradeProtocols {
+			if strings.EqualFold(item, name) {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			log.Printf("upgrade to %s isn't allowed\n", offered)
+			return false
+		}
+	}
+	return true
+}
+
+// switchProtocols relays a 101 response to the client and turns the connections into a tunnel
+func switchProtocols(settings *Settings, clientConn, serverConn *protocol.Conn, upstream Upstream,
+	url string, request *protocol.Request, response *protocol.Response) (*protocol.Error, connState) {
+	if !request.Upgrade {
+		upstreamPool.Put(upstream, serverConn, false)
+		return &protocol.Error{protocol.StatusBadGateway,
+			errors.New("server switches protocols without an upgrade request")}, connClose
+	}
+	settings.rewriteHeaders(url, request, response)
+	response.Protocol = "HTTP/1.1"
+	response.Upgrade = true
+	err := response.WriteTo(clientConn)
+	if err != nil {
+		upstreamPool.Put(upstream, serverConn, false)
+		return &protocol.Error{0, err}, connClose
+	}
+
+	upstreamPool.Release(upstream)
+	relayTunnel(clientConn, serverConn)
+	return nil, connHijacked
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"./protocol"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+)
+
+type URLRewriteConfig struct {
+	Pattern, Replacement string
+	Redirect             int // a status code to redirect the client with, or 0 to change the URL transparently
+}
+
+type URLRewrite struct {
+	Pattern     *regexp.Regexp
+	Replacement string
+	Redirect    int
+}
+
+func compileURLRewrite(rewriteConfig URLRewriteConfig) (URLRewrite, error) {
+	switch rewriteConfig.Redirect {
+	case 0, protocol.StatusMovedPermanently, protocol.StatusFound,
+		protocol.StatusTemporaryRedirect, protocol.StatusPermanentRedirect:
+	default:
+		return URLRewrite{}, fmt.Errorf("%d isn't a redirect status", rewriteConfig.Redirect)
+	}
+	pattern, err := regexp.Compile(rewriteConfig.Pattern)
+	if err != nil {
+		return URLRewrite{}, err
+	}
+	return URLRewrite{pattern, rewriteConfig.Replacement, rewriteConfig.Redirect}, nil
+}
+
+func checkQueryParamPatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		_, err := path.Match(pattern, "")
+		if err != nil {
+			return fmt.Errorf("invalid pattern %s: %s", pattern, err)
+		}
+	}
+	return nil
+}
+
+// stripQueryParams removes the query parameters matching the glob patterns
+// and keeps the order and the encoding of the other ones
+func stripQueryParams(rawURL string, patterns []string) string {
+	index := strings.IndexByte(rawURL, '?')
+	if index == -1 || len(patterns) == 0 {
+		return rawURL
+	}
+
+	var kept []string
+	for _, param := range strings.Split(rawURL[index+1:], "&") {
+		name := strings.SplitN(param, "=", 2)[0]
+		if unescaped, err := url.QueryUnescape(name); err == nil {
+			name = unescaped
+		}
+		stripped := false
+		for _, pattern := range patterns {
+			if matched, _ := path.Match(pattern, name); matched {
+				stripped = true
+				break
+			}
+		}
+		if !stripped {
+			kept = append(kept, param)
+		}
+	}
+	if kept == nil {
+		return rawURL[:index]
+	}
+	return rawURL[:index+1] + strings.Join(kept, "&")
+}
+
+// rewriteURL applies the URL rewriting rules. If the client should be redirected,
+// it returns the redirect status as well.
+func (settings *Settings) rewriteURL(rawURL string) (string, int) {
+	result := stripQueryParams(rawURL, settings.StripQueryParams)
+	for _, rewrite := range settings.urlRewrites {
+		if !rewrite.Pattern.MatchString(result) {
+			continue
+		}
+		result = rewrite.Pattern.ReplaceAllString(result, rewrite.Replacement)
+		if rewrite.Redirect != 0 {
+			log.Printf("redirecting %s to %s\n", rawURL, result)
+			return result, rewrite.Redirect
+		}
+	}
+	if result != rawURL {
+		log.Printf("rewrote %s to %s\n", rawURL, result)
+	}
+	return result, 0
+}
+
+// hostHeader returns the value of the Host header for a URL
+func hostHeader(rawURL string) (string, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	host, port := parsed.Hostname(), parsed.Port()
+	if port == "" || parsed.Scheme == "http" && port == "80" || parsed.Scheme == "https" && port == "443" {
+		if strings.ContainsRune(host, ':') {
+			return "[" + host + "]", nil
+		}
+		return host, nil
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+func sendRedirectResponse(clientConn net.Conn, status int, location string, keepAlive bool) error {
+	response := &protocol.Response{
+		Protocol: "HTTP/1.1",
+		Code:     status,
+		Reason:   protocol.StatusText[status],
+		MessageBase: protocol.MessageBase{
+			Headers:   append(defaultResponseHeaders(), protocol.Header{"Location", location}),
+			KeepAlive: keepAlive,
+		},
+	}
+	response.SetContentLength(0)
+	return response.WriteTo(clientConn)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"./protocol"
+	"strings"
+	"testing"
+)
+
+func TestStripQueryParams(t *testing.T) {
+	patterns := []string{"utm_*", "fbclid", "gclid"}
+	tests := []struct {
+		url, want string
+	}{
+		{"http://example.com/", "http://example.com/"},
+		{"http://example.com/?utm_source=a", "http://example.com/"},
+		{"http://example.com/?id=1&utm_source=a&utm_medium=b", "http://example.com/?id=1"},
+		{"http://example.com/?fbclid=x&b=%20&a=1", "http://example.com/?b=%20&a=1"},
+		{"http://example.com/?utm%5Fsource=a&q=1", "http://example.com/?q=1"},
+		{"http://example.com/?xutm_source=a&flag", "http://example.com/?xutm_source=a&flag"},
+		{"http://example.com/?", "http://example.com/?"},
+	}
+	for _, test := range tests {
+		if got := stripQueryParams(test.url, patterns); got != test.want {
+			t.Errorf("stripQueryParams(%q) = %q, want %q", test.url, got, test.want)
+		}
+	}
+	if err := checkQueryParamPatterns([]string{"utm_["}); err == nil {
+		t.Error("an invalid pattern is accepted")
+	}
+}
+
+func TestRewriteURL(t *testing.T) {
+	settings := loadTestSettings(t, map[string]interface{}{
+		"StripQueryParams": []string{"utm_*"},
+		"RewriteURLs": []map[string]interface{}{
+			{"Pattern": "^http://old\\.example\\.com/(.*)", "Replacement": "http://new.example.com/$1", "Redirect": 301},
+			{"Pattern": "^http://example\\.com/amp/(.*)", "Replacement": "http://example.com/$1"},
+		},
+	})
+	tests := []struct {
+		url, want string
+		redirect  int
+	}{
+		{"http://old.example.com/a?utm_source=x", "http://new.example.com/a", protocol.StatusMovedPermanently},
+		{"http://example.com/amp/page?id=1&utm_medium=y", "http://example.com/page?id=1", 0},
+		{"http://other.example/", "http://other.example/", 0},
+	}
+	for _, test := range tests {
+		url, redirect := settings.rewriteURL(test.url)
+		if url != test.want || redirect != test.redirect {
+			t.Errorf("rewriteURL(%q) = %q, %d, want %q, %d", test.url, url, redirect, test.want, test.redirect)
+		}
+	}
+
+	_, err := compileURLRewrite(URLRewriteConfig{Pattern: ".*", Redirect: 200})
+	if err == nil || !strings.Contains(err.Error(), "redirect") {
+		t.Errorf("got error %v for a status that isn't a redirect", err)
+	}
+}
+
+func TestHostHeader(t *testing.T) {
+	tests := []struct {
+		url, want string
+	}{
+		{"http://example.com/", "example.com"},
+		{"http://example.com:80/", "example.com"},
+		{"https://example.com:443/", "example.com"},
+		{"http://example.com:443/", "example.com:443"},
+		{"http://[::1]:8080/", "[::1]:8080"},
+		{"http://[::1]/", "[::1]"},
+	}
+	for _, test := range tests {
+		if got, err := hostHeader(test.url); err != nil || got != test.want {
+			t.Errorf("hostHeader(%q) = %q, %v, want %q", test.url, got, err, test.want)
+		}
+	}
+}